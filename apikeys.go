@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyPrefix starts every API key, so requireAuth can tell keys from
+// session tokens
+const apiKeyPrefix = "nck_"
+
+// apiKeyScopes are the permissions an API key may be given. Managing staff
+// accounts and keys always needs a staff login.
+var apiKeyScopes = []Permission{
+	PermOrdersRead, PermOrdersConfirm, PermOrdersPrepare, PermOrdersDeliver,
+	PermOrdersCancel, PermOrdersRefund, PermProductsWrite, PermPromotionsManage,
+}
+
+// APIKey lets a machine integration such as a POS terminal call the API.
+// Only the SHA-256 hash of the key is stored; the key itself is shown once
+// when it is created.
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Prefix    string             `bson:"prefix" json:"prefix"` // start of the key, to tell keys apart
+	Hash      string             `bson:"hash" json:"-"`
+	Scopes    []Permission       `bson:"scopes" json:"scopes"`
+	CreatedBy string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// isAPIKey reports whether token is an API key rather than a session token
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// hashAPIKey returns the hash an API key is stored under
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey returns the API key for key. Unknown and expired keys give
+// ErrNotFound.
+func lookupAPIKey(key string) (APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	apiKey, err := store.GetAPIKeyByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		return APIKey{}, err
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return APIKey{}, ErrNotFound
+	}
+	return apiKey, nil
+}
+
+// isAPIKeyScope reports whether scope may be given to an API key
+func isAPIKeyScope(scope Permission) bool {
+	return hasPermission(apiKeyScopes, scope)
+}
+
+// getAPIKeys lists all API keys
+func getAPIKeys(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	keys, err := store.ListAPIKeys(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// createAPIKey creates a key and returns it. This is the only time the key
+// itself is available.
+func createAPIKey(c *gin.Context) {
+	var req struct {
+		Name      string       `json:"name" binding:"required"`
+		Scopes    []Permission `json:"scopes" binding:"required"`
+		ExpiresAt *time.Time   `json:"expiresAt"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name and scopes are required"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !isAPIKeyScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or unavailable scope " + string(scope), "allowed": apiKeyScopes})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	key := apiKeyPrefix + token
+	apiKey := APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(key),
+		Scopes:    req.Scopes,
+		CreatedBy: c.GetString("username"),
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.InsertAPIKey(ctx, apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	recordAudit(c, AuditAPIKeyCreated, apiKey.Name, map[string]interface{}{"id": apiKey.ID.Hex(), "scopes": apiKey.Scopes})
+	c.JSON(http.StatusCreated, gin.H{"key": key, "apiKey": apiKey})
+}
+
+// revokeAPIKey deletes an API key; requests using it fail from then on
+func revokeAPIKey(c *gin.Context) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.DeleteAPIKey(ctx, objectID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	recordAudit(c, AuditAPIKeyRevoked, objectID.Hex(), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audit actions
+const (
+	AuditLoginSucceeded = "login.succeeded"
+	AuditLoginFailed    = "login.failed"
+	AuditLoginLocked    = "login.locked"
+	AuditLoginUnlocked  = "login.unlocked"
+	AuditLogout         = "logout"
+
+	AuditTwoFactorEnabled  = "2fa.enabled"
+	AuditTwoFactorDisabled = "2fa.disabled"
+	AuditTwoFactorReset    = "2fa.reset"
+
+	AuditAPIKeyCreated = "apikey.created"
+	AuditAPIKeyRevoked = "apikey.revoked"
+
+	AuditProductCreated = "product.created"
+	AuditProductUpdated = "product.updated"
+	AuditProductDeleted = "product.deleted"
+
+	AuditPromotionCreated = "promotion.created"
+	AuditPromotionUpdated = "promotion.updated"
+	AuditPromotionDeleted = "promotion.deleted"
+
+	AuditOrderStatusChanged = "order.status_changed"
+
+	AuditUserCreated   = "user.created"
+	AuditUserUpdated   = "user.updated"
+	AuditUserDeleted   = "user.deleted"
+	AuditUserLoggedOut = "user.logged_out"
+)
+
+// Page sizes of the audit log API. auditMaxPage keeps the offset of the
+// last page well within range.
+const (
+	auditDefaultPerPage = 50
+	auditMaxPerPage     = 200
+	auditMaxPage        = 100000
+)
+
+// AuditEntry records a security-relevant or administrative event: who did
+// what to which account or record, from where, and what it looked like
+// before and after. Entries are never changed or deleted.
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Action    string                 `bson:"action" json:"action"`
+	Actor     string                 `bson:"actor" json:"actor"`   // logged-in user, empty for anonymous requests
+	Target    string                 `bson:"target" json:"target"` // account or record acted on
+	IP        string                 `bson:"ip" json:"ip"`
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	Before    map[string]interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After     map[string]interface{} `bson:"after,omitempty" json:"after,omitempty"`
+	CreatedAt time.Time              `bson:"createdAt" json:"createdAt"`
+}
+
+// AuditFilter selects audit entries; empty fields match everything
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// matches reports whether entry passes the filter, ignoring Offset and Limit
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.Action == "" || entry.Action == f.Action) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Target == "" || entry.Target == f.Target) &&
+		(f.Since.IsZero() || !entry.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.CreatedAt.Before(f.Until))
+}
+
+// recordAudit stores an audit entry for the request. The request has
+// already been handled, so failures are only logged.
+func recordAudit(c *gin.Context, action, target string, details map[string]interface{}) {
+	saveAudit(AuditEntry{
+		Action:  action,
+		Actor:   c.GetString("username"),
+		Target:  target,
+		IP:      c.ClientIP(),
+		Details: details,
+	})
+}
+
+// recordAuditChange is recordAudit for changes to a record. before is nil
+// for records that were created and after is nil for deleted ones.
+func recordAuditChange(c *gin.Context, action, target string, before, after interface{}) {
+	saveAudit(AuditEntry{
+		Action: action,
+		Actor:  c.GetString("username"),
+		Target: target,
+		IP:     c.ClientIP(),
+		Before: auditValue(before),
+		After:  auditValue(after),
+	})
+}
+
+// saveAudit stores entry, stamping its ID and time
+func saveAudit(entry AuditEntry) {
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.InsertAuditEntry(ctx, entry); err != nil {
+		log.Printf("Failed to record audit entry %s for %q: %v", entry.Action, entry.Target, err)
+	}
+}
+
+// auditValue converts a record to the map kept in an audit entry, using its
+// JSON form so secrets tagged json:"-" stay out of the log
+func auditValue(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode audit value: %v", err)
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Printf("Failed to encode audit value: %v", err)
+		return nil
+	}
+	return m
+}
+
+// getAuditLog returns audit entries, newest first. Query parameters action,
+// actor and target filter on exact values, since and until (RFC 3339) on
+// time; page and limit select the page.
+func getAuditLog(c *gin.Context) {
+	filter := AuditFilter{
+		Action: c.Query("action"),
+		Actor:  c.Query("actor"),
+		Target: c.Query("target"),
+		Limit:  auditDefaultPerPage,
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " time, use RFC 3339"})
+				return
+			}
+			*t = parsed.Local()
+		}
+	}
+
+	page := 1
+	if value := c.Query("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > auditMaxPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Page must be between 1 and " + strconv.Itoa(auditMaxPage)})
+			return
+		}
+		page = n
+	}
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > auditMaxPerPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(auditMaxPerPage)})
+			return
+		}
+		filter.Limit = n
+	}
+	filter.Offset = (page - 1) * filter.Limit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entries, total, err := store.ListAuditEntries(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"limit":   filter.Limit,
+	})
+}
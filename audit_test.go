@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetAuditLogPaging(t *testing.T) {
+	newTestStore(t)
+	router := gin.New()
+	router.GET("/api/audit", getAuditLog)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"?page=2&limit=10", http.StatusOK},
+		{"?page=" + strconv.Itoa(auditMaxPage), http.StatusOK},
+		{"?page=0", http.StatusBadRequest},
+		{"?page=" + strconv.Itoa(auditMaxPage+1), http.StatusBadRequest},
+		{"?page=9223372036854775807&limit=200", http.StatusBadRequest},
+		{"?limit=" + strconv.Itoa(auditMaxPerPage+1), http.StatusBadRequest},
+		{"?since=yesterday", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := doJSON(router, http.MethodGet, "/api/audit"+tt.query, "", nil); w.Code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.query, w.Code, w.Body, tt.want)
+		}
+	}
+}
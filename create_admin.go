@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// runCreateAdmin implements `ncaffe create-admin`. It adds the first owner
+// account, prompting for the details on a terminal or reading the username
+// and password as lines from stdin otherwise.
+func runCreateAdmin(args []string, in *os.File, out io.Writer) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	flags.SetOutput(out)
+	username := flags.String("username", "", "username of the owner account (read from stdin when empty)")
+	name := flags.String("name", "Owner", "display name of the owner account")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	interactive := term.IsTerminal(int(in.Fd()))
+	lines := bufio.NewReader(in)
+
+	if *username == "" {
+		if interactive {
+			fmt.Fprint(out, "Username: ")
+		}
+		line, err := readLine(lines)
+		if err != nil {
+			return fmt.Errorf("reading username: %w", err)
+		}
+		*username = line
+	}
+
+	var password string
+	if interactive {
+		fmt.Fprint(out, "Password: ")
+		first, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		if err != nil {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		fmt.Fprint(out, "Repeat password: ")
+		second, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		if err != nil {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		if string(first) != string(second) {
+			return errors.New("passwords do not match")
+		}
+		password = string(first)
+	} else {
+		line, err := readLine(lines)
+		if err != nil {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		password = line
+	}
+
+	owner, err := newStaffUser(*username, *name, RoleOwner, password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err = openStore(ctx)
+	if err != nil {
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	defer store.Close(ctx)
+
+	owners, err := countOwners(ctx)
+	if err != nil {
+		return err
+	}
+	if owners > 0 {
+		return errors.New("an owner account already exists, add more staff through the users API")
+	}
+
+	if err := store.InsertUser(ctx, owner); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			return fmt.Errorf("username %q is already taken", owner.Username)
+		}
+		return err
+	}
+	fmt.Fprintf(out, "Created owner account %q\n", owner.Username)
+	return nil
+}
+
+// readLine reads one line without its line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
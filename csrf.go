@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// Requests that authenticate with the auth_token or customer_token cookie
+// must echo the session's CSRF token in this header on anything but GET,
+// HEAD and OPTIONS. Pages read the token from the csrf_token (or
+// customer_csrf_token) cookie or the login response. Requests with an
+// Authorization header are not affected, since other sites can't make the
+// browser send one.
+const (
+	csrfHeader         = "X-CSRF-Token"
+	csrfCookie         = "csrf_token"
+	customerCSRFCookie = "customer_csrf_token"
+)
+
+// errCSRF means a cookie-authenticated request lacked the CSRF token
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+// csrfToken derives the CSRF token of a session from its token. Only
+// someone who knows the session token can compute it, so nothing needs to
+// be stored.
+func csrfToken(sessionToken string) string {
+	sum := sha256.Sum256([]byte("csrf\x00" + sessionToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// csrfSafeMethod reports whether method never changes state
+func csrfSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRF reports whether the request carries the CSRF token of the
+// session it authenticates with
+func validCSRF(c *gin.Context, sessionToken string) bool {
+	got := c.GetHeader(csrfHeader)
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(csrfToken(sessionToken))) == 1
+}
+
+// setCSRFCookie hands the CSRF token to scripts on our own pages in the
+// cookie name. Unlike the session cookie it is readable from JavaScript;
+// other sites still can't read it.
+func setCSRFCookie(c *gin.Context, name, sessionToken string, maxAge int) {
+	value := ""
+	if maxAge >= 0 {
+		value = csrfToken(sessionToken)
+	}
+	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	setCookieWithSameSite(c, name, value, maxAge, "/", "", isSecure, false)
+}
+
+// corsConfig allows cross-origin requests only from the origins listed in
+// ALLOWED_ORIGINS (comma separated, e.g. "https://shop.example.com").
+// Same-origin pages, including the ones served through ngrok, never need
+// to be listed.
+func corsConfig() cors.Config {
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(getEnv("ALLOWED_ORIGINS", ""), ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			log.Println("Ignoring \"*\" in ALLOWED_ORIGINS, list the origins explicitly")
+			continue
+		}
+		allowed[strings.ToLower(origin)] = true
+	}
+
+	config := cors.DefaultConfig()
+	config.AllowOriginFunc = func(origin string) bool {
+		return allowed[strings.ToLower(origin)]
+	}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With", "Idempotency-Key", csrfHeader}
+	config.AllowCredentials = true
+	config.ExposeHeaders = []string{"Content-Length", "Content-Type", "Idempotent-Replayed"}
+	return config
+}
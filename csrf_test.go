@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidCSRF(t *testing.T) {
+	const session = "session-token"
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"matching token", csrfToken(session), true},
+		{"missing", "", false},
+		{"other session's token", csrfToken("other-session"), false},
+		{"session token itself", session, false},
+		{"truncated", csrfToken(session)[:63], false},
+		{"altered", "x" + csrfToken(session)[1:], false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		if tt.header != "" {
+			c.Request.Header.Set(csrfHeader, tt.header)
+		}
+		if got := validCSRF(c, session); got != tt.want {
+			t.Errorf("%s: validCSRF = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	if csrfToken("a") != csrfToken("a") {
+		t.Error("token is not stable for a session")
+	}
+	if csrfToken("a") == csrfToken("b") {
+		t.Error("two sessions share a token")
+	}
+}
+
+func TestCSRFSafeMethod(t *testing.T) {
+	for method, want := range map[string]bool{
+		http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+		http.MethodPost: false, http.MethodPut: false, http.MethodPatch: false, http.MethodDelete: false,
+	} {
+		if got := csrfSafeMethod(method); got != want {
+			t.Errorf("csrfSafeMethod(%s) = %v, want %v", method, got, want)
+		}
+	}
+}
+
+func TestAuthenticateChecksCSRF(t *testing.T) {
+	newTestStore(t)
+	token := staffToken(t, RoleOwner)
+
+	router := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	router.GET("/check", requireAuth(PermOrdersRead), ok)
+	router.POST("/check", requireAuth(PermOrdersRead), ok)
+
+	tests := []struct {
+		name   string
+		method string
+		cookie bool
+		bearer bool
+		csrf   string
+		want   int
+	}{
+		{"cookie without token", http.MethodPost, true, false, "", http.StatusForbidden},
+		{"cookie with wrong token", http.MethodPost, true, false, csrfToken("other"), http.StatusForbidden},
+		{"cookie with token", http.MethodPost, true, false, csrfToken(token), http.StatusNoContent},
+		{"cookie on a GET", http.MethodGet, true, false, "", http.StatusNoContent},
+		{"bearer without token", http.MethodPost, false, true, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/check", nil)
+		if tt.cookie {
+			req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+		}
+		if tt.bearer {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if tt.csrf != "" {
+			req.Header.Set(csrfHeader, tt.csrf)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}
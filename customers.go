@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrCustomerExists is returned by Store.InsertCustomer when the email is taken
+var ErrCustomerExists = errors.New("customer already exists")
+
+// customerSessionRole is the Session.Role of customer logins. Customer
+// sessions are keyed by email and kept in customerSessions, apart from staff
+// sessions.
+const customerSessionRole = "customer"
+
+// customerCookie holds the customer session token, so a customer and a staff
+// login in the same browser don't replace each other
+const customerCookie = "customer_token"
+
+const maxSavedAddresses = 10
+
+var (
+	errInvalidEmail     = errors.New("A valid email address is required")
+	errInvalidAddress   = errors.New("Saved addresses need a unique label and an address")
+	errTooManyAddresses = errors.New("Too many saved addresses")
+)
+
+// CustomerAccount is a registered customer. Orders placed while logged in
+// are linked to it through Order.CustomerID.
+type CustomerAccount struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Email        string             `bson:"email" json:"email"`
+	Name         string             `bson:"name" json:"name"`
+	Phone        string             `bson:"phone" json:"phone"`
+	Addresses    []SavedAddress     `bson:"addresses" json:"addresses"`
+	PasswordHash string             `bson:"password" json:"-"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// SavedAddress is a delivery address kept on a customer account
+type SavedAddress struct {
+	Label   string `bson:"label" json:"label"` // e.g. "Home"
+	Address string `bson:"address" json:"address"`
+	Region  string `bson:"region,omitempty" json:"region,omitempty"` // tax region, see Customer.Region
+}
+
+// CustomerUpdate holds profile changes; empty fields and a nil Addresses
+// are left unchanged
+type CustomerUpdate struct {
+	Name      string
+	Phone     string
+	Addresses []SavedAddress
+}
+
+// normalizeEmail validates an email address and returns it lowercased
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errInvalidEmail
+	}
+	return email, nil
+}
+
+// validateAddresses trims saved addresses and checks the labels are unique
+func validateAddresses(addresses []SavedAddress) ([]SavedAddress, error) {
+	if len(addresses) > maxSavedAddresses {
+		return nil, errTooManyAddresses
+	}
+	seen := make(map[string]bool)
+	cleaned := make([]SavedAddress, 0, len(addresses))
+	for _, a := range addresses {
+		a.Label = strings.TrimSpace(a.Label)
+		a.Address = strings.TrimSpace(a.Address)
+		a.Region = strings.TrimSpace(a.Region)
+		key := strings.ToLower(a.Label)
+		if a.Label == "" || a.Address == "" || seen[key] {
+			return nil, errInvalidAddress
+		}
+		seen[key] = true
+		cleaned = append(cleaned, a)
+	}
+	return cleaned, nil
+}
+
+// fillCustomer completes the customer details of an order from the account.
+// Fields given in the order win; the address is the saved one with label,
+// or the first saved address when no label is given.
+func fillCustomer(customer Customer, account CustomerAccount, label string) (Customer, error) {
+	if customer.Name == "" {
+		customer.Name = account.Name
+	}
+	if customer.Email == "" {
+		customer.Email = account.Email
+	}
+	if customer.Phone == "" {
+		customer.Phone = account.Phone
+	}
+	if customer.Address != "" {
+		return customer, nil
+	}
+	for _, a := range account.Addresses {
+		if label == "" || strings.EqualFold(a.Label, label) {
+			customer.Address = a.Address
+			if customer.Region == "" {
+				customer.Region = a.Region
+			}
+			return customer, nil
+		}
+	}
+	if label != "" {
+		return Customer{}, errors.New("No saved address called " + label)
+	}
+	return customer, nil
+}
+
+// customerRequestToken returns the customer session token from the
+// Authorization header or, failing that, the customer_token cookie
+func customerRequestToken(c *gin.Context) (token string, fromCookie bool) {
+	if token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != "" {
+		return token, false
+	}
+	cookie, err := c.Cookie(customerCookie)
+	if err != nil {
+		return "", false
+	}
+	return cookie, true
+}
+
+// lookupCustomerSession is lookupSession for customer logins
+func lookupCustomerSession(token string) (Session, error) {
+	return lookupSession(customerSessions, token)
+}
+
+// requestCustomer returns the account of the customer logged in on the
+// request, if any. Unknown or expired sessions count as not logged in.
+func requestCustomer(c *gin.Context) (CustomerAccount, bool, error) {
+	token, fromCookie := customerRequestToken(c)
+	if token == "" || isAPIKey(token) {
+		return CustomerAccount{}, false, nil
+	}
+	session, err := lookupCustomerSession(token)
+	if errors.Is(err, ErrNotFound) {
+		return CustomerAccount{}, false, nil
+	}
+	if err != nil {
+		return CustomerAccount{}, false, err
+	}
+	if fromCookie && !csrfSafeMethod(c.Request.Method) && !validCSRF(c, token) {
+		return CustomerAccount{}, false, errCSRF
+	}
+	touchSession(customerSessions, session)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	account, err := store.GetCustomerByEmail(ctx, session.Username)
+	if errors.Is(err, ErrNotFound) {
+		return CustomerAccount{}, false, nil
+	}
+	return account, err == nil, err
+}
+
+// requireCustomer is the middleware for customer endpoints. It makes the
+// logged-in customer's account available as "customer".
+func requireCustomer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, ok, err := requestCustomer(c)
+		switch {
+		case errors.Is(err, errCSRF):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+		case !ok:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Please log in"})
+		default:
+			c.Set("customer", account)
+			c.Next()
+			return
+		}
+		c.Abort()
+	}
+}
+
+// startCustomerSession logs account in on the device making the request
+// and sets the session cookies
+func startCustomerSession(ctx context.Context, c *gin.Context, account CustomerAccount) (string, Session, error) {
+	token, session, err := insertSession(ctx, c, customerSessions, account.Email, customerSessionRole, false)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	setCookieWithSameSite(c, customerCookie, token, int(sessionMaxAge.Seconds()), "/", "", isSecure, true)
+	setCSRFCookie(c, customerCSRFCookie, token, int(sessionMaxAge.Seconds()))
+	return token, session, nil
+}
+
+// startCustomerLogin starts a session for account and sends the token,
+// like completeLogin does for staff
+func startCustomerLogin(ctx context.Context, c *gin.Context, account CustomerAccount, status int) {
+	token, session, err := startCustomerSession(ctx, c, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"token":     token,
+		"csrfToken": csrfToken(token),
+		"expiresIn": int(time.Until(session.ExpiresAt).Seconds()),
+		"customer":  account,
+	})
+}
+
+// registerCustomer creates a customer account and logs it in
+func registerCustomer(c *gin.Context) {
+	var req struct {
+		Email     string         `json:"email" binding:"required"`
+		Password  string         `json:"password" binding:"required"`
+		Name      string         `json:"name"`
+		Phone     string         `json:"phone"`
+		Addresses []SavedAddress `json:"addresses"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email and password are required"})
+		return
+	}
+
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	addresses, err := validateAddresses(req.Addresses)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		if errors.Is(err, errWeakPassword) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		return
+	}
+
+	account := CustomerAccount{
+		ID:           primitive.NewObjectID(),
+		Email:        email,
+		Name:         strings.TrimSpace(req.Name),
+		Phone:        strings.TrimSpace(req.Phone),
+		Addresses:    addresses,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.InsertCustomer(ctx, account); err != nil {
+		if errors.Is(err, ErrCustomerExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		return
+	}
+
+	startCustomerLogin(ctx, c, account, http.StatusCreated)
+}
+
+// loginCustomer logs a customer in. Failures are throttled like staff logins.
+func loginCustomer(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	until, err := loginBlockedUntil(ctx, email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if !until.IsZero() {
+		rejectThrottledLogin(c, until)
+		return
+	}
+
+	account, err := store.GetCustomerByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	// Accounts from magic links have no password
+	hasPassword := err == nil && account.PasswordHash != ""
+	hash := account.PasswordHash
+	if !hasPassword {
+		// Spend the same time as a wrong password so emails can't be probed
+		hash = string(dummyPasswordHash)
+	}
+	if !checkPassword(hash, req.Password) || !hasPassword {
+		recordLoginFailure(ctx, c, email)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+
+	clearLoginFailures(ctx, email)
+	startCustomerLogin(ctx, c, account, http.StatusOK)
+}
+
+// logoutCustomer ends the customer session and clears its cookies
+func logoutCustomer(c *gin.Context) {
+	token, fromCookie := customerRequestToken(c)
+	if fromCookie && !validCSRF(c, token) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+		return
+	}
+	if _, err := lookupCustomerSession(token); err == nil {
+		if err := endSession(customerSessions, token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+
+	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	setCookieWithSameSite(c, customerCookie, "", -1, "/", "", isSecure, true)
+	setCSRFCookie(c, customerCSRFCookie, "", -1)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// getMe returns the logged-in customer's profile
+func getMe(c *gin.Context) {
+	c.JSON(http.StatusOK, c.MustGet("customer").(CustomerAccount))
+}
+
+// updateMe changes the logged-in customer's name, phone or saved addresses
+func updateMe(c *gin.Context) {
+	var req struct {
+		Name      string         `json:"name"`
+		Phone     string         `json:"phone"`
+		Addresses []SavedAddress `json:"addresses"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	update := CustomerUpdate{Name: strings.TrimSpace(req.Name), Phone: strings.TrimSpace(req.Phone)}
+	if req.Addresses != nil {
+		addresses, err := validateAddresses(req.Addresses)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		update.Addresses = addresses
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	account := c.MustGet("customer").(CustomerAccount)
+	account, err := store.UpdateCustomer(ctx, account.ID, update)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// getMyOrders returns the logged-in customer's orders, active and
+// delivered, newest first
+func getMyOrders(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	account := c.MustGet("customer").(CustomerAccount)
+	orders, err := store.ListCustomerOrders(ctx, account.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
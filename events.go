@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Order event types
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderStatusChanged = "order.status_changed"
+	EventOrderDelivered     = "order.delivered"
+
+	// eventResync tells a client it missed events that can no longer be
+	// replayed and should reload the orders
+	eventResync = "resync"
+)
+
+const (
+	// eventHistorySize is how many recent events are kept for replay after a reconnect
+	eventHistorySize = 500
+
+	// subscriberBuffer is how many events a slow client may fall behind
+	// before it is disconnected; it catches up by replaying on reconnect
+	subscriberBuffer = 64
+
+	// sseHeartbeat keeps idle connections open through proxies such as ngrok
+	sseHeartbeat = 25 * time.Second
+)
+
+// OrderEvent is a change to an order pushed to staff clients
+type OrderEvent struct {
+	ID    string    `json:"id"`
+	Seq   int64     `json:"-"`
+	Type  string    `json:"type"`
+	Order Order     `json:"order"`
+	At    time.Time `json:"at"`
+}
+
+// eventBroker fans order events out to subscribers and keeps the most
+// recent ones for replay. Event IDs are "<epoch>-<seq>", where the epoch
+// changes on every restart so stale IDs can be recognised.
+type eventBroker struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         int64
+	history     []OrderEvent
+	subscribers map[chan OrderEvent]struct{}
+}
+
+var orderEvents = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: make(map[chan OrderEvent]struct{}),
+	}
+}
+
+// Publish records an event and delivers it to every subscriber. Subscribers
+// whose buffer is full are dropped instead of blocking the publisher.
+func (b *eventBroker) Publish(eventType string, order Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := OrderEvent{
+		ID:    fmt.Sprintf("%s-%d", b.epoch, b.seq),
+		Seq:   b.seq,
+		Type:  eventType,
+		Order: order,
+		At:    time.Now(),
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe registers a new subscriber. The events after lastEventID are
+// returned for replay; resync is true when they are no longer available.
+// The channel is closed when the subscriber falls too far behind.
+func (b *eventBroker) Subscribe(lastEventID string) (ch chan OrderEvent, replay []OrderEvent, resync bool, unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastEventID != "" {
+		replay, resync = b.since(lastEventID)
+	}
+
+	ch = make(chan OrderEvent, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, replay, resync, unsubscribe
+}
+
+// since returns the events after lastEventID. Callers must hold b.mu.
+func (b *eventBroker) since(lastEventID string) (events []OrderEvent, resync bool) {
+	epoch, seqStr, ok := strings.Cut(lastEventID, "-")
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if !ok || err != nil || epoch != b.epoch || seq > b.seq {
+		// From before a restart, or not one of ours
+		return nil, true
+	}
+	if seq == b.seq {
+		return nil, false
+	}
+	if len(b.history) == 0 || b.history[0].Seq > seq+1 {
+		// Some of the missed events have already been dropped from history
+		return nil, true
+	}
+
+	for _, event := range b.history {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events, false
+}
+
+// streamOrderEvents pushes order events to the client as server-sent events.
+// Browsers resend the last received ID in Last-Event-ID when reconnecting,
+// and everything missed since then is replayed first.
+func streamOrderEvents(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	events, replay, resync, unsubscribe := orderEvents.Subscribe(lastEventID)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop nginx-style proxies from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if resync {
+		c.Render(-1, sse.Event{Event: eventResync, Data: gin.H{"reason": "missed events are no longer available"}})
+	}
+	for _, event := range replay {
+		c.Render(-1, sse.Event{Id: event.ID, Event: event.Type, Data: event})
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Fell too far behind; the client reconnects and replays
+				return
+			}
+			c.Render(-1, sse.Event{Id: event.ID, Event: event.Type, Data: event})
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			// Streams stay open for hours; stop once the login or key no
+			// longer allows reading orders
+			if !streamStillAllowed(c) {
+				return
+			}
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// streamStillAllowed checks again that the session or API key the stream
+// was opened with can read orders. Logging out, revoking the session or
+// key, a key expiring and a role change all end the stream; failures to
+// reach the store don't.
+func streamStillAllowed(c *gin.Context) bool {
+	token, _ := requestToken(c)
+	if isAPIKey(token) {
+		apiKey, err := lookupAPIKey(token)
+		if err != nil {
+			return !errors.Is(err, ErrNotFound)
+		}
+		return hasPermission(apiKey.Scopes, PermOrdersRead)
+	}
+	session, err := lookupStaffSession(token)
+	if err != nil {
+		return !errors.Is(err, ErrNotFound)
+	}
+	return roleCan(session.Role, PermOrdersRead)
+}
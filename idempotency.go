@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrIdempotencyKeyExists is returned by Store.ReserveIdempotencyKey when the key is taken
+var ErrIdempotencyKeyExists = errors.New("idempotency key already exists")
+
+var (
+	// idempotencyTTL is how long a response is kept for replay, set with IDEMPOTENCY_TTL
+	idempotencyTTL = 24 * time.Hour
+
+	// idempotencyLockTimeout is how long a reservation without a response
+	// blocks its key before it is considered abandoned, e.g. after a crash
+	idempotencyLockTimeout = time.Minute
+)
+
+// IdempotencyRecord is a reserved Idempotency-Key and, once the request
+// finished, the response to replay
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"` // see idempotencyRecordKey
+	Owner       string    `bson:"owner"`
+	RequestHash string    `bson:"requestHash"`
+	StatusCode  int       `bson:"statusCode"` // 0 while the request is in progress
+	Response    []byte    `bson:"response,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+// loadIdempotencyTTL reads the replay window from the environment
+func loadIdempotencyTTL() {
+	value := getEnv("IDEMPOTENCY_TTL", "")
+	if value == "" {
+		return
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Ignoring invalid IDEMPOTENCY_TTL=%q, using %s", value, idempotencyTTL)
+		return
+	}
+	idempotencyTTL = ttl
+}
+
+// responseRecorder keeps a copy of everything written to the response
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyScope identifies the caller an Idempotency-Key belongs to: the
+// logged-in customer, the staff member or API key, or else the client's IP
+// address
+func idempotencyScope(c *gin.Context) string {
+	if account, ok, err := requestCustomer(c); err == nil && ok {
+		return "customer:" + account.ID.Hex()
+	}
+	if token, _ := requestToken(c); token != "" {
+		if isAPIKey(token) {
+			if apiKey, err := lookupAPIKey(token); err == nil {
+				return "api-key:" + apiKey.ID.Hex()
+			}
+		} else if session, err := lookupStaffSession(token); err == nil {
+			return "staff:" + session.Username
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// idempotencyRecordKey is the stored key of an Idempotency-Key sent by the
+// caller in scope, so two clients that pick the same key never see each
+// other's responses
+func idempotencyRecordKey(scope, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotent makes a handler safe to retry with an Idempotency-Key header.
+// The first successful response for a key is stored for idempotencyTTL and
+// replayed for later requests from the same caller with the same key and
+// body; reusing a key with a different body is rejected. Requests without
+// the header are handled normally.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+
+		body, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The key is bound to the endpoint and the exact request body
+		sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.FullPath()+"\n"), body...))
+		owner, err := generateToken()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request"})
+			return
+		}
+		now := time.Now()
+		record := IdempotencyRecord{
+			Key:         idempotencyRecordKey(idempotencyScope(c), key),
+			Owner:       owner,
+			RequestHash: hex.EncodeToString(sum[:]),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(idempotencyTTL),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		existing, err := reserveIdempotencyKey(ctx, record)
+		if errors.Is(err, ErrIdempotencyKeyExists) {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			case existing.StatusCode == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+			default:
+				// Replay the original response
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.StatusCode, "application/json; charset=utf-8", existing.Response)
+				c.Abort()
+			}
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request"})
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Only successful responses are kept; anything else frees the key so the client can retry
+		status := recorder.Status()
+		if status >= 200 && status < 300 {
+			record.StatusCode = status
+			record.Response = recorder.body.Bytes()
+			err = store.CompleteIdempotencyKey(ctx, record)
+		} else {
+			err = store.ReleaseIdempotencyKey(ctx, record)
+		}
+		if err != nil {
+			log.Printf("Failed to update idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// reserveIdempotencyKey reserves record.Key, taking over reservations that
+// have expired or were abandoned mid-request. When the key is in use it
+// returns the existing record and ErrIdempotencyKeyExists.
+func reserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	existing, err := store.ReserveIdempotencyKey(ctx, record)
+	if !errors.Is(err, ErrIdempotencyKeyExists) {
+		return existing, err
+	}
+
+	now := time.Now()
+	abandoned := existing.StatusCode == 0 && now.Sub(existing.CreatedAt) > idempotencyLockTimeout
+	if !now.After(existing.ExpiresAt) && !abandoned {
+		return existing, err
+	}
+
+	if err := store.ReleaseIdempotencyKey(ctx, existing); err != nil {
+		return IdempotencyRecord{}, err
+	}
+	return store.ReserveIdempotencyKey(ctx, record)
+}
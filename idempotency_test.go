@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testClientScope is the scope of requests made by doJSON, which come from
+// httptest's default client address
+const testClientScope = "ip:192.0.2.1"
+
+func TestIdempotentReplay(t *testing.T) {
+	router := newTestServer(t)
+
+	first := doJSON(router, http.MethodPost, "/api/orders", "", testOrder(), "Idempotency-Key", "order-1")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request: got %d %s", first.Code, first.Body)
+	}
+	second := doJSON(router, http.MethodPost, "/api/orders", "", testOrder(), "Idempotency-Key", "order-1")
+	if second.Code != http.StatusCreated {
+		t.Fatalf("retry: got %d %s", second.Code, second.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry was not marked as replayed")
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("retry answered %s, want %s", second.Body, first.Body)
+	}
+
+	orders, err := store.ListOrders(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 {
+		t.Errorf("%d orders saved, want 1", len(orders))
+	}
+}
+
+func TestIdempotentKeys(t *testing.T) {
+	other := testOrder()
+	other["items"] = []gin.H{{"productId": 2, "quantity": 1}}
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		key          string
+		existing     *IdempotencyRecord // already stored for key "k" of the test client
+		body         gin.H
+		headers      []string
+		want         int
+		wantReplayed bool
+	}{
+		{
+			name: "no key",
+			body: testOrder(),
+			want: http.StatusCreated,
+		},
+		{
+			name: "key too long",
+			key:  strings.Repeat("k", 256),
+			body: testOrder(),
+			want: http.StatusBadRequest,
+		},
+		{
+			name:         "completed",
+			key:          "k",
+			existing:     &IdempotencyRecord{StatusCode: http.StatusCreated, Response: []byte(`{"orderId":7}`), CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			body:         testOrder(),
+			want:         http.StatusCreated,
+			wantReplayed: true,
+		},
+		{
+			name:     "different body",
+			key:      "k",
+			existing: &IdempotencyRecord{StatusCode: http.StatusCreated, Response: []byte(`{"orderId":7}`), CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			body:     other,
+			want:     http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "still in progress",
+			key:      "k",
+			existing: &IdempotencyRecord{CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			body:     testOrder(),
+			want:     http.StatusConflict,
+		},
+		{
+			name:     "abandoned is taken over",
+			key:      "k",
+			existing: &IdempotencyRecord{CreatedAt: now.Add(-2 * idempotencyLockTimeout), ExpiresAt: now.Add(time.Hour)},
+			body:     testOrder(),
+			want:     http.StatusCreated,
+		},
+		{
+			name:     "expired is taken over",
+			key:      "k",
+			existing: &IdempotencyRecord{StatusCode: http.StatusCreated, Response: []byte(`{"orderId":7}`), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+			body:     testOrder(),
+			want:     http.StatusCreated,
+		},
+		{
+			name:     "other client",
+			key:      "k",
+			existing: &IdempotencyRecord{StatusCode: http.StatusCreated, Response: []byte(`{"orderId":7}`), CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			body:     testOrder(),
+			headers:  []string{"X-Forwarded-For", "198.51.100.9"},
+			want:     http.StatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestServer(t)
+			if tt.existing != nil {
+				record := *tt.existing
+				record.Key = idempotencyRecordKey(testClientScope, "k")
+				record.Owner = "earlier"
+				record.RequestHash = testRequestHash(t, testOrder())
+				if _, err := store.ReserveIdempotencyKey(context.Background(), record); err != nil {
+					t.Fatal(err)
+				}
+				if record.StatusCode != 0 {
+					if err := store.CompleteIdempotencyKey(context.Background(), record); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			headers := tt.headers
+			if tt.key != "" {
+				headers = append(headers, "Idempotency-Key", tt.key)
+			}
+			w := doJSON(router, http.MethodPost, "/api/orders", "", tt.body, headers...)
+			if w.Code != tt.want {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && w.Body.String() != `{"orderId":7}` {
+				t.Errorf("replayed %s, want the stored response", w.Body)
+			}
+		})
+	}
+}
+
+func TestIdempotentFailureFreesKey(t *testing.T) {
+	router := newTestServer(t)
+	bad := gin.H{"items": []gin.H{{"productId": 999, "quantity": 1}}}
+
+	w := doJSON(router, http.MethodPost, "/api/orders", "", bad, "Idempotency-Key", "k")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d %s, want 422", w.Code, w.Body)
+	}
+
+	// The failed request must not block a corrected retry with the same key
+	record := IdempotencyRecord{
+		Key:       idempotencyRecordKey(testClientScope, "k"),
+		Owner:     "retry",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if _, err := store.ReserveIdempotencyKey(context.Background(), record); err != nil {
+		t.Errorf("key still reserved after a failed request: %v", err)
+	}
+}
+
+func TestIdempotencyRecordKeyScoped(t *testing.T) {
+	a := idempotencyRecordKey("ip:192.0.2.1", "k")
+	if a != idempotencyRecordKey("ip:192.0.2.1", "k") {
+		t.Error("same scope and key gave different record keys")
+	}
+	if a == idempotencyRecordKey("ip:192.0.2.2", "k") {
+		t.Error("different scopes share a record key")
+	}
+	if a == idempotencyRecordKey("customer:192.0.2.1", "k") {
+		t.Error("different kinds of caller share a record key")
+	}
+}
+
+// testRequestHash is the request hash idempotent computes for an order
+// posted to /api/orders
+func testRequestHash(t *testing.T, body gin.H) string {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(append([]byte("POST /api/orders\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
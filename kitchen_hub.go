@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// kitchenWriteWait is how long a single write to a display may take
+	kitchenWriteWait = 10 * time.Second
+
+	// kitchenPongWait is how long a display may stay silent before it is
+	// considered gone; pings are sent well within that window
+	kitchenPongWait   = 60 * time.Second
+	kitchenPingPeriod = kitchenPongWait * 9 / 10
+
+	// kitchenMaxMessage limits the size of messages sent by a display
+	kitchenMaxMessage = 4096
+
+	// kitchenSendBuffer is how many messages a display may fall behind
+	// before it is disconnected
+	kitchenSendBuffer = 64
+)
+
+// kitchenBumpNext is where bumping a ticket moves it in the kitchen
+var kitchenBumpNext = map[string]string{
+	StatusPending:   StatusConfirmed,
+	StatusConfirmed: StatusBaking,
+	StatusBaking:    StatusReady,
+}
+
+// kitchenMessage is a message on the kitchen WebSocket, in either direction.
+//
+// Displays send "ack" (confirm a new ticket), "bump" (move a ticket to its
+// next kitchen stage), "status" (move a ticket to Status) and "ping". The
+// server sends "hello", the order event types, "resync", "error" and "pong".
+type kitchenMessage struct {
+	Type    string `json:"type"`
+	OrderID string `json:"orderId,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Note    string `json:"note,omitempty"`
+	Order   *Order `json:"order,omitempty"`
+	User    string `json:"user,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// kitchenHub broadcasts order events to every connected kitchen display
+type kitchenHub struct {
+	mu      sync.Mutex
+	clients map[*kitchenClient]struct{}
+}
+
+var kitchen = &kitchenHub{clients: make(map[*kitchenClient]struct{})}
+
+var kitchenUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// CheckOrigin is left nil so only same-origin pages can connect with
+	// the staff session cookie
+}
+
+// run forwards order events to all displays. If the hub itself falls
+// behind the event broker, displays are told to resync.
+func (h *kitchenHub) run() {
+	for {
+		events, _, _, unsubscribe := orderEvents.Subscribe("")
+		for event := range events {
+			order := event.Order
+			h.broadcast(kitchenMessage{Type: event.Type, Order: &order})
+		}
+		unsubscribe()
+		h.broadcast(kitchenMessage{Type: eventResync})
+	}
+}
+
+func (h *kitchenHub) register(client *kitchenClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[client] = struct{}{}
+}
+
+func (h *kitchenHub) unregister(client *kitchenClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+func (h *kitchenHub) broadcast(msg kitchenMessage) {
+	h.mu.Lock()
+	clients := make([]*kitchenClient, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		client.enqueue(msg)
+	}
+}
+
+// kitchenClient is one connected kitchen display
+type kitchenClient struct {
+	conn      *websocket.Conn
+	username  string
+	role      string
+	token     string
+	ip        string
+	send      chan kitchenMessage
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    string
+}
+
+// enqueue queues msg for the display, disconnecting it if it can't keep up
+func (cl *kitchenClient) enqueue(msg kitchenMessage) {
+	select {
+	case cl.send <- msg:
+	case <-cl.done:
+	default:
+		cl.close("too slow to keep up")
+	}
+}
+
+// close disconnects the display, telling it why
+func (cl *kitchenClient) close(reason string) {
+	cl.closeOnce.Do(func() {
+		cl.reason = reason
+		kitchen.unregister(cl)
+		close(cl.done)
+	})
+}
+
+// serveKitchenSocket upgrades an authenticated request to the kitchen WebSocket
+func serveKitchenSocket(c *gin.Context) {
+	conn, err := kitchenUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+
+	client := &kitchenClient{
+		conn:     conn,
+		username: c.GetString("username"),
+		role:     c.GetString("role"),
+		token:    c.GetString("sessionToken"),
+		ip:       c.ClientIP(),
+		send:     make(chan kitchenMessage, kitchenSendBuffer),
+		done:     make(chan struct{}),
+	}
+	kitchen.register(client)
+	client.enqueue(kitchenMessage{Type: "hello", User: client.username})
+
+	go client.writePump()
+	client.readPump()
+}
+
+// readPump handles commands from the display until the connection ends
+func (cl *kitchenClient) readPump() {
+	defer cl.close("connection closed")
+
+	cl.conn.SetReadLimit(kitchenMaxMessage)
+	cl.conn.SetReadDeadline(time.Now().Add(kitchenPongWait))
+	cl.conn.SetPongHandler(func(string) error {
+		return cl.conn.SetReadDeadline(time.Now().Add(kitchenPongWait))
+	})
+
+	for {
+		var msg kitchenMessage
+		if err := cl.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Kitchen display of %s: %v", cl.username, err)
+			}
+			return
+		}
+		cl.conn.SetReadDeadline(time.Now().Add(kitchenPongWait))
+
+		session, err := lookupSession(sessions, cl.token)
+		if errors.Is(err, ErrNotFound) {
+			cl.close("session expired")
+			return
+		}
+		if err == nil {
+			touchSession(sessions, session)
+		}
+		cl.handle(msg)
+	}
+}
+
+// writePump sends queued messages and heartbeats to the display
+func (cl *kitchenClient) writePump() {
+	ticker := time.NewTicker(kitchenPingPeriod)
+	defer func() {
+		ticker.Stop()
+		cl.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-cl.send:
+			cl.conn.SetWriteDeadline(time.Now().Add(kitchenWriteWait))
+			if err := cl.conn.WriteJSON(msg); err != nil {
+				cl.close("write failed")
+				return
+			}
+		case <-ticker.C:
+			// Displays stay connected for a whole shift; drop them once the login expires
+			if _, err := lookupSession(sessions, cl.token); errors.Is(err, ErrNotFound) {
+				cl.close("session expired")
+				continue
+			}
+			cl.conn.SetWriteDeadline(time.Now().Add(kitchenWriteWait))
+			if err := cl.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				cl.close("ping failed")
+				return
+			}
+		case <-cl.done:
+			cl.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, cl.reason),
+				time.Now().Add(kitchenWriteWait))
+			return
+		}
+	}
+}
+
+// handle runs a single command from the display. The resulting order
+// change reaches every display, this one included, through the event broker.
+func (cl *kitchenClient) handle(msg kitchenMessage) {
+	if msg.Type == "ping" {
+		cl.enqueue(kitchenMessage{Type: "pong"})
+		return
+	}
+
+	reply := func(errMsg string) {
+		cl.enqueue(kitchenMessage{Type: "error", OrderID: msg.OrderID, Error: errMsg})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(msg.OrderID)
+	if err != nil {
+		reply("Invalid order ID format")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var to string
+	switch msg.Type {
+	case "ack":
+		to = StatusConfirmed
+	case "bump":
+		order, err := store.GetOrder(ctx, objectID)
+		if err != nil {
+			reply("Order not found")
+			return
+		}
+		next, ok := kitchenBumpNext[order.Status]
+		if !ok {
+			reply("Order has left the kitchen")
+			return
+		}
+		to = next
+	case "status":
+		if !isOrderStatus(msg.Status) {
+			reply("Unknown order status")
+			return
+		}
+		to = msg.Status
+	default:
+		reply("Unknown message type")
+		return
+	}
+	if !canSetStatus(rolePermissions[cl.role], to) {
+		reply(fmt.Sprintf("Your role cannot mark orders as %s", to))
+		return
+	}
+
+	order, err := changeOrderStatus(ctx, objectID, to, cl.username, msg.Note)
+	if err != nil {
+		var transErr *transitionError
+		switch {
+		case errors.As(err, &transErr):
+			reply(transErr.Error())
+		case errors.Is(err, ErrStatusConflict):
+			reply("Order status was changed by someone else")
+		case errors.Is(err, ErrNotFound):
+			reply("Order not found")
+		default:
+			reply("Failed to update order status")
+		}
+		return
+	}
+	auditStatusChange(cl.username, cl.ip, order)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// loginMaxFailures failed logins lock an account for loginLockout, set
+	// with LOGIN_MAX_FAILURES and LOGIN_LOCKOUT. A single IP address is
+	// locked out after loginIPFailureFactor times as many failures, since a
+	// whole shop often shares one address.
+	loginMaxFailures     = 10
+	loginLockout         = 15 * time.Minute
+	loginIPFailureFactor = 5
+
+	// loginFreeAttempts failures are allowed before each further attempt
+	// has to wait, starting at loginBaseDelay and doubling up to loginMaxDelay
+	loginFreeAttempts = 3
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 5 * time.Minute
+)
+
+// LoginThrottle counts recent failed logins for a username or IP address.
+// Failures older than loginLockout no longer count.
+type LoginThrottle struct {
+	Key           string    `bson:"_id"` // e.g. "user:<username>" or "ip:<address>"
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"lastFailureAt"`
+}
+
+// loadLoginThrottleConfig reads the lockout settings from the environment
+func loadLoginThrottleConfig() {
+	loginMaxFailures = getEnvInt("LOGIN_MAX_FAILURES", loginMaxFailures)
+	loginLockout = getEnvDuration("LOGIN_LOCKOUT", loginLockout)
+}
+
+func userThrottleKey(username string) string { return "user:" + username }
+func ipThrottleKey(ip string) string         { return "ip:" + ip }
+
+// blockedUntil returns when the next login attempt is allowed, given
+// the failures recorded so far and how many failures lock the key out
+func (t LoginThrottle) blockedUntil(maxFailures int) time.Time {
+	switch {
+	case t.Failures >= maxFailures:
+		return t.LastFailureAt.Add(loginLockout)
+	case t.Failures <= loginFreeAttempts:
+		return time.Time{}
+	}
+
+	delay := loginBaseDelay
+	for i := loginFreeAttempts + 1; i < t.Failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	return t.LastFailureAt.Add(delay)
+}
+
+// loginBlockedUntil returns when username may try to log in from ip
+// again, or the zero time if it may try now
+func loginBlockedUntil(ctx context.Context, username, ip string) (time.Time, error) {
+	var until time.Time
+	checks := []struct {
+		key         string
+		maxFailures int
+	}{
+		{userThrottleKey(username), loginMaxFailures},
+		{ipThrottleKey(ip), loginMaxFailures * loginIPFailureFactor},
+	}
+	for _, check := range checks {
+		throttle, err := store.GetLoginThrottle(ctx, check.key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t := throttle.blockedUntil(check.maxFailures); t.After(until) {
+			until = t
+		}
+	}
+	if !until.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// recordLoginFailure counts a failed login for username and ip, and
+// audits it along with any lockout it causes
+func recordLoginFailure(ctx context.Context, c *gin.Context, username string) {
+	now := time.Now()
+	ip := c.ClientIP()
+
+	userThrottle, err := store.RecordLoginFailure(ctx, userThrottleKey(username), now, loginLockout)
+	if err != nil {
+		log.Printf("Failed to record failed login for %q: %v", username, err)
+	}
+	ipThrottle, err := store.RecordLoginFailure(ctx, ipThrottleKey(ip), now, loginLockout)
+	if err != nil {
+		log.Printf("Failed to record failed login from %s: %v", ip, err)
+	}
+
+	recordAudit(c, AuditLoginFailed, username, map[string]interface{}{"failures": userThrottle.Failures})
+	if userThrottle.Failures == loginMaxFailures {
+		recordAudit(c, AuditLoginLocked, username, map[string]interface{}{"until": now.Add(loginLockout)})
+	}
+	if ipThrottle.Failures == loginMaxFailures*loginIPFailureFactor {
+		recordAudit(c, AuditLoginLocked, ipThrottleKey(ip), map[string]interface{}{"until": now.Add(loginLockout)})
+	}
+}
+
+// clearLoginFailures forgets the failed logins of username after it
+// logged in. Failures from the IP address still count.
+func clearLoginFailures(ctx context.Context, username string) {
+	err := store.DeleteLoginThrottle(ctx, userThrottleKey(username))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to clear failed logins for %q: %v", username, err)
+	}
+}
+
+// rejectThrottledLogin answers a login attempt made while blocked
+func rejectThrottledLogin(c *gin.Context, until time.Time) {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      "Too many failed login attempts, try again later",
+		"retryAfter": retryAfter,
+	})
+}
+
+// unlockUser clears the failed logins and lockout of a staff account
+func unlockUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := normalizeUsername(c.Param("username"))
+	if _, err := store.GetUser(ctx, username); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	err := store.DeleteLoginThrottle(ctx, userThrottleKey(username))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	recordAudit(c, AuditLoginUnlocked, username, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
+
+// cleanupLoginThrottles periodically removes failure counts that no longer
+// block anything, which also lifts lockouts that have run out
+func cleanupLoginThrottles() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Nothing blocks for longer than the lockout, the longest delay or
+		// the sign-in link window
+		retention := loginLockout
+		if loginMaxDelay > retention {
+			retention = loginMaxDelay
+		}
+		if magicLinkRequestWindow > retention {
+			retention = magicLinkRequestWindow
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := store.DeleteStaleLoginThrottles(ctx, time.Now().Add(-retention)); err != nil {
+			log.Println("Failed to remove expired login throttles:", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBlockedUntil(t *testing.T) {
+	last := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures    int
+		maxFailures int
+		want        time.Duration // after the last failure; 0 means not blocked
+	}{
+		{0, 10, 0},
+		{1, 10, 0},
+		{loginFreeAttempts, 10, 0},
+		{loginFreeAttempts + 1, 10, time.Second},
+		{loginFreeAttempts + 2, 10, 2 * time.Second},
+		{loginFreeAttempts + 3, 10, 4 * time.Second},
+		{9, 10, 32 * time.Second},
+		{10, 10, loginLockout},
+		{25, 10, loginLockout},
+		{20, 100, loginMaxDelay}, // the delay stops doubling at the maximum
+		{50, 50, loginLockout},
+	}
+	for _, tt := range tests {
+		throttle := LoginThrottle{Failures: tt.failures, LastFailureAt: last}
+		got := throttle.blockedUntil(tt.maxFailures)
+		var want time.Time
+		if tt.want != 0 {
+			want = last.Add(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%d of %d failures: blocked until %v, want %v", tt.failures, tt.maxFailures, got, want)
+		}
+	}
+}
+
+func TestRecordLoginFailureWindow(t *testing.T) {
+	newTestStore(t)
+	ctx := context.Background()
+	start := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		throttle, err := store.RecordLoginFailure(ctx, "user:sam", start.Add(time.Duration(i)*time.Minute), loginLockout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if throttle.Failures != i {
+			t.Errorf("failure %d counted as %d", i, throttle.Failures)
+		}
+	}
+
+	// Failures older than the window no longer count
+	throttle, err := store.RecordLoginFailure(ctx, "user:sam", start.Add(3*time.Minute+loginLockout+time.Second), loginLockout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Failures != 1 {
+		t.Errorf("failures after the window = %d, want 1", throttle.Failures)
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	newTestStore(t)
+	router := gin.New()
+	router.POST("/api/auth/login", handleLogin)
+
+	user, err := newStaffUser("sam", "Sam", RoleBaker, "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	login := func(password string, headers ...string) *httptest.ResponseRecorder {
+		return doJSON(router, http.MethodPost, "/api/auth/login", "", gin.H{"username": "sam", "password": password}, headers...)
+	}
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want 401", i+1, w.Code)
+		}
+	}
+	// The next failure starts the backoff, which blocks even the right password
+	if w := login("wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want 401", w.Code)
+	}
+	w := login("correct-horse")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("during backoff: got %d, want 429", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", w.Header().Get("Retry-After"))
+	}
+
+	// Another address is held up by the username all the same
+	if w := login("correct-horse", "X-Forwarded-For", "198.51.100.9"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("from another address: got %d, want 429", w.Code)
+	}
+
+	// Once the backoff is lifted the right password works and clears the count
+	if err := store.DeleteLoginThrottle(context.Background(), userThrottleKey("sam")); err != nil {
+		t.Fatal(err)
+	}
+	if w := login("correct-horse", "X-Forwarded-For", "198.51.100.9"); w.Code != http.StatusOK {
+		t.Fatalf("after unlocking: got %d %s, want 200", w.Code, w.Body)
+	}
+	if _, err := store.GetLoginThrottle(context.Background(), userThrottleKey("sam")); err != ErrNotFound {
+		t.Errorf("failures not cleared after logging in: %v", err)
+	}
+}
+
+func TestLoginThrottledByIP(t *testing.T) {
+	newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	// Failures spread over many usernames still add up for the address
+	for i := 0; i < loginMaxFailures*loginIPFailureFactor; i++ {
+		if _, err := store.RecordLoginFailure(ctx, ipThrottleKey("203.0.113.5"), now, loginLockout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	until, err := loginBlockedUntil(ctx, "someone-new", "203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.Equal(now.Add(loginLockout)) {
+		t.Errorf("blocked until %v, want the lockout %v", until, now.Add(loginLockout))
+	}
+
+	until, err = loginBlockedUntil(ctx, "someone-new", "203.0.113.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.IsZero() {
+		t.Errorf("another address is blocked until %v", until)
+	}
+}
+
+func TestTwoFactorSetupThrottled(t *testing.T) {
+	newTestStore(t)
+	router := gin.New()
+	router.POST("/api/auth/2fa/setup", requireStaffLogin(), setupTwoFactor)
+	token := staffToken(t, RoleBaker)
+	setup := func(password string) int {
+		return doJSON(router, http.MethodPost, "/api/auth/2fa/setup", token, gin.H{"password": password}).Code
+	}
+
+	// Wrong passwords count as failed logins for the account
+	for i := 0; i <= loginFreeAttempts; i++ {
+		if code := setup("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want 401", i+1, code)
+		}
+	}
+	if code := setup("password1234"); code != http.StatusTooManyRequests {
+		t.Errorf("during backoff: got %d, want 429", code)
+	}
+}
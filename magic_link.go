@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// magicLinkTTL is how long a sign-in link works (MAGIC_LINK_TTL)
+var magicLinkTTL = 15 * time.Minute
+
+// A single address gets at most magicLinkMaxPerEmail links, and a single IP
+// address may ask for at most magicLinkMaxPerIP, until no link has been asked
+// for in magicLinkRequestWindow. This keeps the form from being used to
+// flood someone's inbox or the mail server.
+var (
+	magicLinkMaxPerEmail   = 3
+	magicLinkMaxPerIP      = 20
+	magicLinkRequestWindow = 15 * time.Minute
+)
+
+// magicLinkPath is the emailed link; the confirm page it shows posts back to it
+const magicLinkPath = "/api/customers/magic-link/verify"
+
+// magicLinkNonceCookie holds a random value set by the confirm page. Its
+// form sends csrfToken of it back, which other sites can't compute, so
+// they can't sign a visitor in to an account of their choosing.
+const magicLinkNonceCookie = "magic_link_nonce"
+
+// MagicLink is an emailed sign-in link that hasn't been used yet. Only the
+// SHA-256 hash of its token is stored, as the ID.
+type MagicLink struct {
+	ID        string    `bson:"_id"`
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// magicLinkID returns the ID a magic link token is stored under
+func magicLinkID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// publicURL is the address customers reach the shop at, from PUBLIC_URL.
+// Links are never built from the request's Host header, which the client
+// controls: a forged one would send the token to someone else's site.
+func publicURL() string {
+	return strings.TrimRight(getEnv("PUBLIC_URL", ""), "/")
+}
+
+func magicEmailThrottleKey(email string) string { return "magic:" + email }
+func magicIPThrottleKey(ip string) string       { return "magic-ip:" + ip }
+
+// magicLinkAllowed counts a link request against the address and the IP
+// address it came from, and reports whether it is within the limits. If
+// not, it also returns when the limit runs out.
+func magicLinkAllowed(ctx context.Context, email, ip string) (bool, time.Time, error) {
+	now := time.Now()
+	limits := []struct {
+		key string
+		max int
+	}{
+		{magicEmailThrottleKey(email), magicLinkMaxPerEmail},
+		{magicIPThrottleKey(ip), magicLinkMaxPerIP},
+	}
+	for _, limit := range limits {
+		t, err := store.RecordLoginFailure(ctx, limit.key, now, magicLinkRequestWindow)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if t.Failures > limit.max {
+			return false, t.LastFailureAt.Add(magicLinkRequestWindow), nil
+		}
+	}
+	return true, time.Time{}, nil
+}
+
+// requestMagicLink emails a sign-in link. The response is the same whether
+// or not the address has an account; the account is created when the link
+// is first used. Without PUBLIC_URL no links are sent.
+func requestMagicLink(c *gin.Context) {
+	base := publicURL()
+	if base == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Sign-in links are not available"})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	allowed, until, err := magicLinkAllowed(ctx, email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sign-in link"})
+		return
+	}
+	if !allowed {
+		retryAfter := int(time.Until(until).Seconds()) + 1
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":      "Too many sign-in links requested, try again later",
+			"retryAfter": retryAfter,
+		})
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sign-in link"})
+		return
+	}
+	now := time.Now()
+	link := MagicLink{
+		ID:        magicLinkID(token),
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(magicLinkTTL),
+	}
+
+	if err := store.InsertMagicLink(ctx, link); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sign-in link"})
+		return
+	}
+
+	url := base + magicLinkPath + "?token=" + token
+	msg := Email{
+		To:      email,
+		Subject: "Your Subu Bakery sign-in link",
+		Body: fmt.Sprintf("Sign in to Subu Bakery by opening this link:\n\n%s\n\n"+
+			"The link works once and expires in %d minutes. If you didn't ask for it, you can ignore this email.\n",
+			url, int(magicLinkTTL.Minutes())),
+	}
+	// Sending can be slow; don't make the customer wait for the mail server
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("Failed to send sign-in link to %s: %v", email, err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Check your email for a sign-in link"})
+}
+
+// redeemMagicLink uses up the link for token and returns the customer
+// account it signs in to, creating the account on first sign-in. Unknown,
+// used and expired links give ErrNotFound.
+func redeemMagicLink(ctx context.Context, token string) (CustomerAccount, error) {
+	if token == "" {
+		return CustomerAccount{}, ErrNotFound
+	}
+	link, err := store.ConsumeMagicLink(ctx, magicLinkID(token))
+	if err != nil {
+		return CustomerAccount{}, err
+	}
+	if time.Now().After(link.ExpiresAt) {
+		return CustomerAccount{}, ErrNotFound
+	}
+
+	account, err := store.GetCustomerByEmail(ctx, link.Email)
+	if !errors.Is(err, ErrNotFound) {
+		return account, err
+	}
+
+	// The link proves the address, so it can have a passwordless account
+	account = CustomerAccount{
+		ID:        primitive.NewObjectID(),
+		Email:     link.Email,
+		Addresses: []SavedAddress{},
+		CreatedAt: time.Now(),
+	}
+	err = store.InsertCustomer(ctx, account)
+	if errors.Is(err, ErrCustomerExists) {
+		return store.GetCustomerByEmail(ctx, link.Email)
+	}
+	return account, err
+}
+
+// showMagicLink is the emailed link. It only asks the customer to confirm:
+// mail scanners and link previews open links too, and must neither use the
+// token up nor sign anyone in.
+func showMagicLink(c *gin.Context) {
+	nonce, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to show sign-in page"})
+		return
+	}
+	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	setCookieWithSameSite(c, magicLinkNonceCookie, nonce, int(magicLinkTTL.Seconds()), magicLinkPath, "", isSecure, true)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.HTML(http.StatusOK, "magic_link.html", gin.H{"Token": c.Query("token"), "CSRF": csrfToken(nonce)})
+}
+
+// verifyMagicLink signs the customer in with the token from a magic link.
+// The confirm page posts a form with the token and its CSRF value and is
+// redirected to the shop. Apps post {"token": "..."} as JSON and get the
+// login response; browsers only send JSON to other sites that CORS allows.
+func verifyMagicLink(c *gin.Context) {
+	fromPage := c.ContentType() == "application/x-www-form-urlencoded"
+	var token string
+	switch {
+	case fromPage:
+		nonce, err := c.Cookie(magicLinkNonceCookie)
+		sent := c.PostForm("csrf")
+		if err != nil || nonce == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(csrfToken(nonce))) != 1 {
+			c.HTML(http.StatusForbidden, "magic_link.html", gin.H{"Error": "Open the link from your email again to sign in."})
+			return
+		}
+		token = c.PostForm("token")
+	case c.ContentType() == "application/json":
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		token = req.Token
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Send the token as JSON"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	account, err := redeemMagicLink(ctx, token)
+	if err != nil {
+		status, msg := http.StatusInternalServerError, "Failed to sign in"
+		if errors.Is(err, ErrNotFound) {
+			status, msg = http.StatusBadRequest, "This sign-in link is invalid, used or expired"
+		}
+		if fromPage {
+			c.HTML(status, "magic_link.html", gin.H{"Error": msg})
+		} else {
+			c.JSON(status, gin.H{"error": msg})
+		}
+		return
+	}
+
+	if !fromPage {
+		startCustomerLogin(ctx, c, account, http.StatusOK)
+		return
+	}
+	if _, _, err := startCustomerSession(ctx, c, account); err != nil {
+		c.HTML(http.StatusInternalServerError, "magic_link.html", gin.H{"Error": "Failed to sign in"})
+		return
+	}
+	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	setCookieWithSameSite(c, magicLinkNonceCookie, "", -1, magicLinkPath, "", isSecure, true)
+	c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chanMailer hands sent messages to the test
+type chanMailer chan Email
+
+func (m chanMailer) Send(msg Email) error {
+	m <- msg
+	return nil
+}
+
+// newMagicLinkServer returns a router with the magic link routes and the
+// channel the links are mailed to
+func newMagicLinkServer(t *testing.T) (*gin.Engine, chanMailer) {
+	t.Helper()
+	newTestStore(t)
+	t.Setenv("PUBLIC_URL", "https://shop.example.com/")
+	sent := make(chanMailer, 100)
+	mailer = sent
+
+	router := gin.New()
+	router.LoadHTMLGlob("templates/*")
+	api := router.Group("/api")
+	api.POST("/customers/magic-link", requestMagicLink)
+	api.GET("/customers/magic-link/verify", showMagicLink)
+	api.POST("/customers/magic-link/verify", verifyMagicLink)
+	return router, sent
+}
+
+// requestLink asks for a link for email and returns the token mailed
+func requestLink(t *testing.T, router http.Handler, sent chanMailer, email string) string {
+	t.Helper()
+	w := doJSON(router, http.MethodPost, "/api/customers/magic-link", "", gin.H{"email": email})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request link: got %d %s", w.Code, w.Body)
+	}
+	select {
+	case msg := <-sent:
+		m := regexp.MustCompile(`https://shop\.example\.com` + magicLinkPath + `\?token=(\S+)`).FindStringSubmatch(msg.Body)
+		if m == nil {
+			t.Fatalf("no link in %q", msg.Body)
+		}
+		return m[1]
+	case <-time.After(time.Second):
+		t.Fatal("no email sent")
+		return ""
+	}
+}
+
+// postForm posts the confirm page's form, with the nonce cookie if set
+func postForm(router http.Handler, token, csrf string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	form := url.Values{"token": {token}, "csrf": {csrf}}
+	req := httptest.NewRequest(http.MethodPost, magicLinkPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMagicLinkConfirmPage(t *testing.T) {
+	router, sent := newMagicLinkServer(t)
+	token := requestLink(t, router, sent, "Ann@Example.com")
+
+	// Opening the link, as a mail scanner would, must not use it up
+	var page *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		page = httptest.NewRecorder()
+		router.ServeHTTP(page, httptest.NewRequest(http.MethodGet, magicLinkPath+"?token="+token, nil))
+		if page.Code != http.StatusOK {
+			t.Fatalf("open link: got %d", page.Code)
+		}
+	}
+	cookies := page.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookies = %v, want the nonce", cookies)
+	}
+	nonce := cookies[0]
+	if nonce.Name != magicLinkNonceCookie || !nonce.HttpOnly {
+		t.Fatalf("cookie = %+v, want an HttpOnly %s", nonce, magicLinkNonceCookie)
+	}
+	csrf := csrfToken(nonce.Value)
+	if !strings.Contains(page.Body.String(), csrf) {
+		t.Fatal("page doesn't carry the form's CSRF value")
+	}
+
+	// A form posted from another site has neither the cookie nor the value
+	if w := postForm(router, token, csrf, nil); w.Code != http.StatusForbidden {
+		t.Errorf("without the cookie: got %d, want 403", w.Code)
+	}
+	if w := postForm(router, token, csrfToken("guess"), nonce); w.Code != http.StatusForbidden {
+		t.Errorf("with a wrong value: got %d, want 403", w.Code)
+	}
+
+	w := postForm(router, token, csrf, nonce)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("confirm: got %d to %q, want 303 to /", w.Code, w.Header().Get("Location"))
+	}
+	signedIn := false
+	for _, c := range w.Result().Cookies() {
+		signedIn = signedIn || c.Name == "customer_token" && c.Value != ""
+	}
+	if !signedIn {
+		t.Error("no customer session cookie set")
+	}
+
+	// Each link works once
+	if w := postForm(router, token, csrf, nonce); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: got %d, want 400", w.Code)
+	}
+}
+
+func TestMagicLinkJSON(t *testing.T) {
+	router, sent := newMagicLinkServer(t)
+	token := requestLink(t, router, sent, "ann@example.com")
+
+	req := httptest.NewRequest(http.MethodPost, magicLinkPath, strings.NewReader(`{"token":"`+token+`"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain: got %d, want 415", w.Code)
+	}
+
+	if w := doJSON(router, http.MethodPost, magicLinkPath, "", gin.H{"token": token}); w.Code != http.StatusOK {
+		t.Fatalf("JSON: got %d %s, want 200", w.Code, w.Body)
+	}
+	if w := doJSON(router, http.MethodPost, magicLinkPath, "", gin.H{"token": token}); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: got %d, want 400", w.Code)
+	}
+}
+
+func TestMagicLinkNeedsPublicURL(t *testing.T) {
+	router, _ := newMagicLinkServer(t)
+	t.Setenv("PUBLIC_URL", "")
+
+	w := doJSON(router, http.MethodPost, "/api/customers/magic-link", "", gin.H{"email": "ann@example.com"})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", w.Code)
+	}
+}
+
+func TestMagicLinkRateLimit(t *testing.T) {
+	router, _ := newMagicLinkServer(t)
+	ask := func(email, ip string) int {
+		return doJSON(router, http.MethodPost, "/api/customers/magic-link", "", gin.H{"email": email}, "X-Forwarded-For", ip).Code
+	}
+
+	for i := 0; i < magicLinkMaxPerEmail; i++ {
+		if code := ask("ann@example.com", "198.51.100.1"); code != http.StatusAccepted {
+			t.Fatalf("request %d: got %d, want 202", i+1, code)
+		}
+	}
+	if code := ask("ANN@example.com", "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Errorf("over the address limit: got %d, want 429", code)
+	}
+
+	for i := 0; i < magicLinkMaxPerIP; i++ {
+		ask(fmt.Sprintf("customer%d@example.com", i), "198.51.100.3")
+	}
+	if code := ask("someone@example.com", "198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Errorf("over the IP limit: got %d, want 429", code)
+	}
+	if code := ask("someone@example.com", "198.51.100.4"); code != http.StatusAccepted {
+		t.Errorf("another IP: got %d, want 202", code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email is a plain-text message to one recipient
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(msg Email) error
+}
+
+var mailer Mailer
+
+// openMailer creates the Mailer selected by MAILER: "smtp" sends through the
+// server at SMTP_ADDR, "log" only writes messages to the log. Without MAILER,
+// smtp is used when SMTP_ADDR is set and log otherwise.
+func openMailer() (Mailer, error) {
+	backend := getEnv("MAILER", "")
+	if backend == "" {
+		backend = "log"
+		if getEnv("SMTP_ADDR", "") != "" {
+			backend = "smtp"
+		}
+	}
+
+	switch backend {
+	case "smtp":
+		return newSMTPMailer(getEnv("SMTP_ADDR", "localhost:1025"), getEnv("SMTP_FROM", "Subu Bakery <no-reply@localhost>"))
+	case "log":
+		log.Println("Emails are written to the log, set SMTP_ADDR to send them")
+		return logMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", backend)
+	}
+}
+
+// smtpMailer sends email through an SMTP server, e.g. MailHog on
+// localhost:1025 during development
+type smtpMailer struct {
+	addr string
+	from *mail.Address
+	auth smtp.Auth
+}
+
+// newSMTPMailer returns a Mailer for the server at addr. SMTP_USERNAME and
+// SMTP_PASSWORD enable authentication, which net/smtp only allows over TLS
+// or to localhost.
+func newSMTPMailer(addr, from string) (*smtpMailer, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	m := &smtpMailer{addr: addr, from: fromAddr}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_ADDR: %w", err)
+		}
+		m.auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return m, nil
+}
+
+func (m *smtpMailer) Send(msg Email) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{msg.To}, []byte(b.String()))
+}
+
+// logMailer writes emails to the log instead of sending them
+type logMailer struct{}
+
+func (logMailer) Send(msg Email) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,10 +15,7 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Product represents a bakery item
@@ -26,7 +24,8 @@ type Product struct {
 	ProductID   int                `bson:"productId" json:"productId"`
 	Name        string             `bson:"name" json:"name"`
 	Description string             `bson:"description" json:"description"`
-	Price       float64            `bson:"price" json:"price"`
+	Price       Money              `bson:"price" json:"price"` // with variants, the lowest variant price
+	Variants    []ProductVariant   `bson:"variants,omitempty" json:"variants,omitempty"`
 	Image       string             `bson:"image" json:"image"` // Base64 encoded image or emoji
 	Category    string             `bson:"category" json:"category"`
 	CreatedAt   time.Time          `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
@@ -34,19 +33,43 @@ type Product struct {
 
 // OrderItem represents an item in an order
 type OrderItem struct {
-	ProductID int `json:"productId"`
-	Quantity  int `json:"quantity"`
+	ProductID int    `json:"productId"`
+	SKU       string `bson:"sku,omitempty" json:"sku,omitempty"` // variant ordered, for products with variants
+	Quantity  int    `json:"quantity"`
+
+	// Snapshot of the product when the order was placed, so later product
+	// edits or deletions don't change what the order shows
+	Name      string `bson:"name,omitempty" json:"name,omitempty"`
+	Variant   string `bson:"variant,omitempty" json:"variant,omitempty"` // variant name, e.g. 8"
+	UnitPrice Money  `bson:"unitPrice,omitempty" json:"unitPrice"`
+	Category  string `bson:"category,omitempty" json:"category,omitempty"`
+	LineTotal Money  `bson:"lineTotal,omitempty" json:"lineTotal"`
+
+	// Promotions and tax on the line, see priceOrder
+	Discount Money   `bson:"discount,omitempty" json:"discount"`
+	TaxRate  Percent `bson:"taxRate,omitempty" json:"taxRate"`
+	Tax      Money   `bson:"tax,omitempty" json:"tax"`
 }
 
 // Order represents a customer order
 type Order struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	OrderID   int                `bson:"orderId" json:"orderId"`
-	Customer  Customer           `bson:"customer" json:"customer"`
-	Items     []OrderItem        `bson:"items" json:"items"`
-	Total     float64            `bson:"total" json:"total"`
-	Status    string             `bson:"status" json:"status"`
-	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrderID       int                `bson:"orderId" json:"orderId"`
+	Customer      Customer           `bson:"customer" json:"customer"`
+	CustomerID    string             `bson:"customerId,omitempty" json:"customerId,omitempty"`   // account that placed the order, if logged in
+	Fulfillment   string             `bson:"fulfillment,omitempty" json:"fulfillment,omitempty"` // dine_in, takeaway or delivery
+	Items         []OrderItem        `bson:"items" json:"items"`
+	Subtotal      Money              `bson:"subtotal" json:"subtotal"` // before discounts and tax
+	Discount      Money              `bson:"discount" json:"discount"`
+	Discounts     []AppliedDiscount  `bson:"discounts,omitempty" json:"discounts,omitempty"`
+	CouponCode    string             `bson:"couponCode,omitempty" json:"couponCode,omitempty"`
+	Tax           Money              `bson:"tax" json:"tax"`
+	Total         Money              `bson:"total" json:"total"`
+	TaxIncluded   bool               `bson:"taxIncluded,omitempty" json:"taxIncluded"` // prices already contained the tax
+	Status        string             `bson:"status" json:"status"`
+	StatusHistory []StatusChange     `bson:"statusHistory,omitempty" json:"statusHistory,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	DeliveredAt   *time.Time         `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
 }
 
 // Customer represents customer information
@@ -55,74 +78,92 @@ type Customer struct {
 	Email   string `json:"email"`
 	Phone   string `json:"phone"`
 	Address string `json:"address"`
+	Region  string `json:"region,omitempty"` // state or other tax region, for delivery tax
 }
 
 // Global variables
 var (
-	products            []Product
-	productsMu          sync.RWMutex
-	mongoClient         *mongo.Client
-	productsCollection  *mongo.Collection
-	ordersCollection    *mongo.Collection
-	deliveredCollection *mongo.Collection
-	adminUsername       string
-	adminPassword       string
-	activeSessions      = make(map[string]time.Time)
-	sessionsMu          sync.RWMutex
-	productIDCounter    = 0
+	products         []Product
+	productsMu       sync.RWMutex
+	store            Store
+	sessions         SessionStore // staff logins
+	customerSessions SessionStore // customer logins, kept apart from staff ones
+	productIDCounter = 0
 )
 
 // init function removed - products now loaded from MongoDB
 
 func main() {
-	// Connect to MongoDB
+	// ncaffe create-admin seeds the first owner account and exits
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		if err := runCreateAdmin(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal("create-admin: ", err)
+		}
+		return
+	}
+
+	// Open the configured storage backend (MongoDB by default)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	mongoURI := "mongodb://localhost:27017"
-	if uri := getEnv("MONGODB_URI", ""); uri != "" {
-		mongoURI = uri
+	var err error
+	store, err = openStore(ctx)
+	if err != nil {
+		log.Fatal("Failed to open storage:", err)
 	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	// Login sessions live in the same database, so they survive restarts
+	sessions = store
+	customerSessions = store.CustomerSessions()
+
+	// Email for customer sign-in links
+	mailer, err = openMailer()
 	if err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
+		log.Fatal("Failed to set up email:", err)
+	}
+	magicLinkTTL = getEnvDuration("MAGIC_LINK_TTL", magicLinkTTL)
+	if publicURL() == "" {
+		log.Println("No PUBLIC_URL set, customers can't sign in with email links")
 	}
 
-	// Test connection
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		log.Fatal("Failed to ping MongoDB:", err)
+	// Load products from the store or initialize with defaults
+	loadProductsFromDB()
+
+	// Create the first owner account from ADMIN_USERNAME/ADMIN_PASSWORD
+	if err := ensureOwnerAccount(ctx); err != nil {
+		log.Fatal("Failed to create owner account:", err)
 	}
 
-	mongoClient = client
-	productsCollection = client.Database("sububakery").Collection("products")
-	ordersCollection = client.Database("sububakery").Collection("orders")
-	deliveredCollection = client.Database("sububakery").Collection("delivered")
+	// Per-item and per-order quantity limits
+	loadOrderLimits()
 
-	// Load products from MongoDB or initialize with defaults
-	loadProductsFromDB()
+	// Tax rules by product category, fulfillment and jurisdiction
+	if err := loadTaxConfig(); err != nil {
+		log.Fatal("Failed to load tax rules:", err)
+	}
 
-	// Get admin credentials from environment or use defaults
-	adminUsername = getEnv("ADMIN_USERNAME", "admin")
-	adminPassword = getEnv("ADMIN_PASSWORD", "admin")
+	// How long order responses are kept for Idempotency-Key replays
+	loadIdempotencyTTL()
+
+	// Session idle timeout and maximum age
+	loadSessionConfig()
 
 	// Clean up expired sessions periodically
 	go cleanupSessions()
 
-	fmt.Println("Connected to MongoDB successfully")
-	fmt.Printf("Admin credentials: username='%s', password='%s'\n", adminUsername, adminPassword)
+	// Failed login limits, and lifting lockouts once they run out
+	loadLoginThrottleConfig()
+	go cleanupLoginThrottles()
+
+	// Forward order events to kitchen displays
+	go kitchen.run()
+
+	fmt.Println("Connected to storage successfully")
 
 	router := gin.Default()
 
-	// CORS middleware - configured for ngrok
-	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With"}
-	config.AllowCredentials = true
-	config.ExposeHeaders = []string{"Content-Length", "Content-Type"}
-	router.Use(cors.New(config))
+	// CORS middleware - only same-origin pages and ALLOWED_ORIGINS
+	router.Use(cors.New(corsConfig()))
 
 	// Serve static files
 	router.Static("/static", "./static")
@@ -139,29 +180,76 @@ func main() {
 		c.HTML(http.StatusOK, "orders.html", nil)
 	})
 
+	router.GET("/kitchen", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "kitchen.html", nil)
+	})
+
 	// Public API routes
 	api := router.Group("/api")
 	{
 		api.GET("/products", getProducts)
 		api.GET("/products/:id", getProduct)
-		api.POST("/orders", createOrder)
+		api.POST("/orders", idempotent(), createOrder)
 
 		// Authentication routes
 		api.POST("/auth/login", handleLogin)
+		api.POST("/auth/login/2fa", handleLoginTwoFactor)
 		api.POST("/auth/logout", handleLogout)
 		api.GET("/auth/check", checkAuth)
 
-		// Protected routes (require authentication)
+		// Customer accounts, separate from staff logins
+		api.POST("/customers/register", registerCustomer)
+		api.POST("/customers/login", loginCustomer)
+		api.POST("/customers/logout", logoutCustomer)
+		api.POST("/coupons/validate", validateCoupon)
+		api.POST("/customers/magic-link", requestMagicLink)
+		api.GET("/customers/magic-link/verify", showMagicLink)
+		api.POST("/customers/magic-link/verify", verifyMagicLink)
+		api.GET("/me", requireCustomer(), getMe)
+		api.PUT("/me", requireCustomer(), updateMe)
+		api.GET("/me/orders", requireCustomer(), getMyOrders)
+		api.GET("/auth/sessions", requireStaffLogin(), getMySessions)
+		api.POST("/auth/sessions/revoke-others", requireStaffLogin(), revokeOtherSessions)
+		api.DELETE("/auth/sessions/:id", requireStaffLogin(), revokeMySession)
+		api.POST("/auth/2fa/setup", requireStaffLogin(), setupTwoFactor)
+		api.POST("/auth/2fa/enable", requireStaffLogin(), enableTwoFactor)
+		api.POST("/auth/2fa/disable", requireStaffLogin(), disableTwoFactor)
+		api.POST("/auth/2fa/recovery-codes", requireStaffLogin(), regenerateRecoveryCodes)
+
+		// Protected routes (require a staff login with the given permission;
+		// requireAuth routes also accept API keys with that scope)
 		protected := api.Group("")
-		protected.Use(requireAuth())
 		{
-			protected.GET("/orders", getOrders)
-			protected.GET("/orders/:id", getOrder)
-			protected.POST("/orders/:id/deliver", markOrderDelivered)
-			protected.GET("/delivered", getDeliveredOrders)
-			protected.POST("/products", createProduct)
-			protected.PUT("/products/:id", updateProduct)
-			protected.DELETE("/products/:id", deleteProduct)
+			protected.GET("/orders", requireAuth(PermOrdersRead), getOrders)
+			protected.GET("/orders/events", requireAuth(PermOrdersRead), streamOrderEvents)
+			protected.GET("/orders/:id", requireAuth(PermOrdersRead), getOrder)
+			// Which statuses a role may set is checked per request, see canSetStatus
+			protected.POST("/orders/:id/status", requireAuth(PermOrdersRead), updateOrderStatus)
+			protected.GET("/delivered", requireAuth(PermOrdersRead), getDeliveredOrders)
+			protected.GET("/kitchen/ws", requireStaffLogin(PermOrdersRead), serveKitchenSocket)
+			protected.POST("/products", requireAuth(PermProductsWrite), createProduct)
+			protected.PUT("/products/:id", requireAuth(PermProductsWrite), updateProduct)
+			protected.DELETE("/products/:id", requireAuth(PermProductsWrite), deleteProduct)
+
+			protected.GET("/users", requireStaffLogin(PermUsersManage), getUsers)
+			protected.POST("/users", requireStaffLogin(PermUsersManage), createUser)
+			protected.PUT("/users/:username", requireStaffLogin(PermUsersManage), updateUser)
+			protected.DELETE("/users/:username", requireStaffLogin(PermUsersManage), deleteUser)
+			protected.GET("/users/:username/sessions", requireStaffLogin(PermUsersManage), getUserSessions)
+			protected.POST("/users/:username/logout", requireStaffLogin(PermUsersManage), forceLogoutUser)
+			protected.POST("/users/:username/unlock", requireStaffLogin(PermUsersManage), unlockUser)
+			protected.POST("/users/:username/2fa/reset", requireStaffLogin(PermUsersManage), resetTwoFactor)
+
+			protected.GET("/api-keys", requireStaffLogin(PermUsersManage), getAPIKeys)
+			protected.POST("/api-keys", requireStaffLogin(PermUsersManage), createAPIKey)
+			protected.DELETE("/api-keys/:id", requireStaffLogin(PermUsersManage), revokeAPIKey)
+
+			protected.GET("/audit", requireStaffLogin(PermAuditRead), getAuditLog)
+
+			protected.GET("/promotions", requireAuth(PermPromotionsManage), getPromotions)
+			protected.POST("/promotions", requireAuth(PermPromotionsManage), createPromotion)
+			protected.PUT("/promotions/:id", requireAuth(PermPromotionsManage), updatePromotion)
+			protected.DELETE("/promotions/:id", requireAuth(PermPromotionsManage), deletePromotion)
 		}
 	}
 
@@ -177,23 +265,31 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDuration reads a positive duration such as "15m" from the environment,
+// falling back to defaultValue
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 // getProducts returns all products
 func getProducts(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := productsCollection.Find(ctx, bson.M{})
+	productsList, err := store.ListProducts(ctx)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var productsList []Product
-	if err = cursor.All(ctx, &productsList); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
-		return
-	}
 
 	c.JSON(http.StatusOK, productsList)
 }
@@ -204,24 +300,24 @@ func getProduct(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	var product Product
+
 	// Try to parse as ObjectID first
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		// Try as productId (int)
-		var product Product
-		err = productsCollection.FindOne(ctx, bson.M{"productId": id}).Decode(&product)
-		if err != nil {
+		productID, convErr := strconv.Atoi(id)
+		if convErr != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
-		c.JSON(http.StatusOK, product)
-		return
+		product, err = store.GetProductByProductID(ctx, productID)
+	} else {
+		product, err = store.GetProduct(ctx, objectID)
 	}
 
-	var product Product
-	err = productsCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&product)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
@@ -235,8 +331,11 @@ func getProduct(c *gin.Context) {
 // createOrder creates a new order
 func createOrder(c *gin.Context) {
 	var orderReq struct {
-		Customer Customer    `json:"customer"`
-		Items    []OrderItem `json:"items"`
+		Customer     Customer           `json:"customer"`
+		AddressLabel string             `json:"addressLabel"` // saved address to deliver to, for logged-in customers
+		Fulfillment  string             `json:"fulfillment"`  // dine_in, takeaway or delivery (default)
+		CouponCode   string             `json:"couponCode"`
+		Items        []orderItemRequest `json:"items"`
 	}
 
 	if err := c.ShouldBindJSON(&orderReq); err != nil {
@@ -244,74 +343,132 @@ func createOrder(c *gin.Context) {
 		return
 	}
 
+	// Logged-in customers get the order linked to their account, with
+	// missing details taken from it
+	account, loggedIn, err := requestCustomer(c)
+	if err != nil {
+		if errors.Is(err, errCSRF) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+		return
+	}
+	var customerID string
+	if loggedIn {
+		orderReq.Customer, err = fillCustomer(orderReq.Customer, account, orderReq.AddressLabel)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		customerID = account.ID.Hex()
+	}
+
 	// Validate order
 	if len(orderReq.Items) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Order must contain at least one item"})
 		return
 	}
+	if orderReq.Fulfillment == "" {
+		orderReq.Fulfillment = defaultFulfillment
+	}
+	if !isFulfillment(orderReq.Fulfillment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Fulfillment must be dine_in, takeaway or delivery"})
+		return
+	}
 
-	// Calculate total
-	var total float64
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	for _, item := range orderReq.Items {
-		var product Product
-		err := productsCollection.FindOne(ctx, bson.M{"productId": item.ProductID}).Decode(&product)
-		if err == nil {
-			total += product.Price * float64(item.Quantity)
-		}
+	// Check every line against the catalogue and snapshot the products
+	items, lineErrors, err := buildOrderItems(ctx, orderReq.Items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	if len(lineErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Order contains invalid items",
+			"items": lineErrors,
+		})
+		return
+	}
+	if totalQuantity(items) > maxOrderQuantity {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Order cannot contain more than %d items in total", maxOrderQuantity),
+		})
+		return
 	}
 
-	// Get next order ID from database
-	nextOrderID, err := getNextOrderID(ctx)
+	// Apply promotions and the coupon, tax every line and total up
+	pricing, err := priceOrder(ctx, items, orderReq.CouponCode, orderReq.Fulfillment, orderReq.Customer)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate order ID"})
+		var couponErr couponError
+		if errors.As(err, &couponErr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": couponErr.msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price order"})
 		return
 	}
 
 	// Create order
+	now := time.Now()
 	order := Order{
-		ID:        primitive.NewObjectID(),
-		OrderID:   nextOrderID,
-		Customer:  orderReq.Customer,
-		Items:     orderReq.Items,
-		Total:     total,
-		Status:    "pending",
-		CreatedAt: time.Now(),
+		ID:          primitive.NewObjectID(),
+		Customer:    orderReq.Customer,
+		CustomerID:  customerID,
+		Fulfillment: orderReq.Fulfillment,
+		Items:       items,
+		Subtotal:    pricing.Subtotal,
+		Discount:    pricing.Discount,
+		Discounts:   pricing.Discounts,
+		CouponCode:  normalizeCouponCode(orderReq.CouponCode),
+		Tax:         pricing.Tax,
+		Total:       pricing.Total,
+		TaxIncluded: taxConfig.PricesIncludeTax,
+		Status:      StatusPending,
+		StatusHistory: []StatusChange{
+			{To: StatusPending, ChangedBy: "customer", ChangedAt: now},
+		},
+		CreatedAt: now,
 	}
 
-	// Insert into MongoDB
-	_, err = ordersCollection.InsertOne(ctx, order)
+	// Count the promotions as used, number the order and save it, all in
+	// one transaction. Limited promotions may have just run out; the order
+	// number is only taken once they are counted.
+	order, err = store.PlaceOrder(ctx, order, pricing.appliedIDs())
 	if err != nil {
+		var promoErr promotionError
+		if errors.As(err, &promoErr) {
+			name := "A promotion"
+			for _, p := range pricing.applied {
+				if p.ID == promoErr.id {
+					name = p.Name
+				}
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": name + " is no longer available, please try again"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save order"})
 		return
 	}
 
+	orderEvents.Publish(EventOrderCreated, order)
+
 	c.JSON(http.StatusCreated, order)
 }
 
-// getOrders returns all orders
+// getOrders returns all orders, newest first
 func getOrders(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Find all orders and sort by createdAt descending (newest first)
-	findOptions := options.Find()
-	findOptions.SetSort(bson.D{primitive.E{Key: "createdAt", Value: -1}})
-
-	cursor, err := ordersCollection.Find(ctx, bson.M{}, findOptions)
+	orders, err := store.ListOrders(ctx)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var orders []Order
-	if err = cursor.All(ctx, &orders); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode orders"})
-		return
-	}
 
 	c.JSON(http.StatusOK, orders)
 }
@@ -331,10 +488,9 @@ func getOrder(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var order Order
-	err = ordersCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&order)
+	order, err := store.GetOrder(ctx, objectID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 			return
 		}
@@ -345,129 +501,127 @@ func getOrder(c *gin.Context) {
 	c.JSON(http.StatusOK, order)
 }
 
-// markOrderDelivered moves an order from orders collection to delivered collection
-func markOrderDelivered(c *gin.Context) {
-	id := c.Param("id")
-
-	// Try to parse as ObjectID
-	objectID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID format"})
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// getDeliveredOrders returns all delivered orders, most recently delivered first
+func getDeliveredOrders(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Find the order in orders collection
-	var order Order
-	err = ordersCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&order)
+	deliveredOrders, err := store.ListDeliveredOrders(ctx)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivered orders"})
 		return
 	}
 
-	// Update order status and add delivered timestamp
-	order.Status = "delivered"
-	deliveredAt := time.Now()
-
-	// Create delivered order document with additional tracking info
-	deliveredOrder := bson.M{
-		"_id":         order.ID,
-		"orderId":     order.OrderID,
-		"customer":    order.Customer,
-		"items":       order.Items,
-		"total":       order.Total,
-		"status":      "delivered",
-		"createdAt":   order.CreatedAt,
-		"deliveredAt": deliveredAt,
-	}
+	c.JSON(http.StatusOK, deliveredOrders)
+}
 
-	// Insert into delivered collection
-	_, err = deliveredCollection.InsertOne(ctx, deliveredOrder)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save delivered order"})
-		return
+// requestToken returns the session token from the Authorization header
+// or, failing that, the auth_token cookie
+func requestToken(c *gin.Context) (token string, fromCookie bool) {
+	token = c.GetHeader("Authorization")
+	if token != "" {
+		// Remove "Bearer " prefix if present
+		if len(token) > 7 && token[:7] == "Bearer " {
+			token = token[7:]
+		}
+		return token, false
 	}
 
-	// Delete from orders collection
-	_, err = ordersCollection.DeleteOne(ctx, bson.M{"_id": objectID})
+	// Try to get from cookie
+	cookie, err := c.Cookie("auth_token")
 	if err != nil {
-		// If delete fails, try to remove from delivered collection to maintain consistency
-		deliveredCollection.DeleteOne(ctx, bson.M{"_id": objectID})
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove order from active orders"})
-		return
+		return "", false
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"message":     "Order marked as delivered",
-		"orderId":     order.OrderID,
-		"deliveredAt": deliveredAt,
-	})
+	return cookie, true
 }
 
-// getDeliveredOrders returns all delivered orders
-func getDeliveredOrders(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// Find all delivered orders and sort by deliveredAt descending (newest first)
-	findOptions := options.Find()
-	findOptions.SetSort(bson.D{primitive.E{Key: "deliveredAt", Value: -1}})
-
-	cursor, err := deliveredCollection.Find(ctx, bson.M{}, findOptions)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivered orders"})
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var deliveredOrders []bson.M
-	if err = cursor.All(ctx, &deliveredOrders); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode delivered orders"})
-		return
-	}
+// requireAuth is the authentication middleware. Requests must come from a
+// logged-in staff member whose role has all of perms, or use an API key
+// with all of perms as scopes. Cookie-authenticated requests that change
+// state also need the session's CSRF token.
+func requireAuth(perms ...Permission) gin.HandlerFunc {
+	return authenticate(true, perms)
+}
 
-	c.JSON(http.StatusOK, deliveredOrders)
+// requireStaffLogin is requireAuth for endpoints that act on a staff
+// account or its sessions, which API keys can't use
+func requireStaffLogin(perms ...Permission) gin.HandlerFunc {
+	return authenticate(false, perms)
 }
 
-// Authentication middleware
-func requireAuth() gin.HandlerFunc {
+func authenticate(allowAPIKeys bool, perms []Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			// Try to get from cookie
-			cookie, err := c.Cookie("auth_token")
-			if err == nil {
-				token = cookie
-			}
-		}
-
+		token, fromCookie := requestToken(c)
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 			c.Abort()
 			return
 		}
 
-		// Remove "Bearer " prefix if present
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
+		if isAPIKey(token) {
+			if !allowAPIKeys || fromCookie {
+				c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot be used here"})
+				c.Abort()
+				return
+			}
+			apiKey, err := lookupAPIKey(token)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+				}
+				c.Abort()
+				return
+			}
+			for _, perm := range perms {
+				if !hasPermission(apiKey.Scopes, perm) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "This API key does not allow this"})
+					c.Abort()
+					return
+				}
+			}
+
+			c.Set("username", "api-key:"+apiKey.Name)
+			c.Set("permissions", apiKey.Scopes)
+			c.Set("apiKeyID", apiKey.ID.Hex())
+			c.Next()
+			return
 		}
 
-		sessionsMu.RLock()
-		expiry, exists := activeSessions[token]
-		sessionsMu.RUnlock()
+		if fromCookie && !csrfSafeMethod(c.Request.Method) && !validCSRF(c, token) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			c.Abort()
+			return
+		}
 
-		if !exists || time.Now().After(expiry) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+		session, err := lookupStaffSession(token)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+			}
 			c.Abort()
 			return
 		}
 
+		for _, perm := range perms {
+			if !roleCan(session.Role, perm) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow this"})
+				c.Abort()
+				return
+			}
+		}
+
+		touchSession(sessions, session)
+
+		// Make the logged-in user and session available to handlers
+		c.Set("username", session.Username)
+		c.Set("role", session.Role)
+		c.Set("permissions", rolePermissions[session.Role])
+		c.Set("sessionToken", token)
+		c.Set("sessionID", session.ID)
 		c.Next()
 	}
 }
@@ -484,83 +638,132 @@ func handleLogin(c *gin.Context) {
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Refuse attempts while the username or IP address is backing off or locked out
+	username := normalizeUsername(loginReq.Username)
+	until, err := loginBlockedUntil(ctx, username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if !until.IsZero() {
+		rejectThrottledLogin(c, until)
+		return
+	}
+
 	// Check credentials
-	if loginReq.Username != adminUsername || loginReq.Password != adminPassword {
+	user, err := store.GetUser(ctx, username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if err != nil {
+		// Spend the same time as a wrong password so usernames can't be probed
+		checkPassword(string(dummyPasswordHash), loginReq.Password)
+		recordLoginFailure(ctx, c, username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if !checkPassword(user.PasswordHash, loginReq.Password) {
+		recordLoginFailure(ctx, c, username)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Generate session token
-	token, err := generateToken()
+	// With 2FA the password only earns a challenge for handleLoginTwoFactor
+	if user.TwoFactor.Enabled {
+		challenge, err := startTwoFactorChallenge(ctx, c, user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"twoFactorRequired": true,
+			"challenge":         challenge,
+			"expiresIn":         int(twoFactorChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	completeLogin(ctx, c, user)
+}
+
+// completeLogin starts a session for user once every login step passed
+func completeLogin(ctx context.Context, c *gin.Context, user StaffUser) {
+	clearLoginFailures(ctx, user.Username)
+
+	// Start a session on this device
+	token, session, err := startSession(ctx, c, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
-
-	// Store session (valid for 24 hours)
-	sessionsMu.Lock()
-	activeSessions[token] = time.Now().Add(24 * time.Hour)
-	sessionsMu.Unlock()
+	c.Set("username", user.Username)
+	recordAudit(c, AuditLoginSucceeded, user.Username, map[string]interface{}{"sessionId": session.ID})
 
 	// Set cookie - configured for ngrok
 	// Check if request is from ngrok (HTTPS) or localhost
+	// The cookie lives as long as the session could; the server enforces the idle timeout
 	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
-	setCookieWithSameSite(c, "auth_token", token, 86400, "/", "", isSecure, true)
+	setCookieWithSameSite(c, "auth_token", token, int(sessionMaxAge.Seconds()), "/", "", isSecure, true)
+	setCSRFCookie(c, csrfCookie, token, int(sessionMaxAge.Seconds()))
 
 	c.JSON(http.StatusOK, gin.H{
-		"token":     token,
-		"message":   "Login successful",
-		"expiresIn": 86400,
+		"token":       token,
+		"csrfToken":   csrfToken(token),
+		"message":     "Login successful",
+		"expiresIn":   int(time.Until(session.ExpiresAt).Seconds()),
+		"username":    user.Username,
+		"role":        user.Role,
+		"permissions": rolePermissions[user.Role],
 	})
 }
 
 // handleLogout processes logout requests
 func handleLogout(c *gin.Context) {
-	token := c.GetHeader("Authorization")
-	if len(token) > 7 && token[:7] == "Bearer " {
-		token = token[7:]
-	} else {
-		cookie, err := c.Cookie("auth_token")
-		if err == nil {
-			token = cookie
-		}
+	token, fromCookie := requestToken(c)
+	if fromCookie && !validCSRF(c, token) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+		return
 	}
 
 	if token != "" {
-		sessionsMu.Lock()
-		delete(activeSessions, token)
-		sessionsMu.Unlock()
+		session, lookupErr := lookupStaffSession(token)
+		if err := endSession(sessions, token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+		if lookupErr == nil {
+			c.Set("username", session.Username)
+			recordAudit(c, AuditLogout, session.Username, map[string]interface{}{"sessionId": session.ID})
+		}
 	}
 
 	// Clear cookie - configured for ngrok
 	isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
 	setCookieWithSameSite(c, "auth_token", "", -1, "/", "", isSecure, true)
+	setCSRFCookie(c, csrfCookie, "", -1)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
 // checkAuth checks if user is authenticated
 func checkAuth(c *gin.Context) {
-	token := c.GetHeader("Authorization")
-	if len(token) > 7 && token[:7] == "Bearer " {
-		token = token[7:]
-	} else {
-		cookie, err := c.Cookie("auth_token")
-		if err == nil {
-			token = cookie
-		}
-	}
-
+	token, _ := requestToken(c)
 	if token == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"authenticated": false})
 		return
 	}
 
-	sessionsMu.RLock()
-	expiry, exists := activeSessions[token]
-	sessionsMu.RUnlock()
-
-	if exists && time.Now().Before(expiry) {
-		c.JSON(http.StatusOK, gin.H{"authenticated": true})
+	if session, err := lookupStaffSession(token); err == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"authenticated": true,
+			"username":      session.Username,
+			"role":          session.Role,
+			"permissions":   rolePermissions[session.Role],
+			"csrfToken":     csrfToken(token),
+		})
 	} else {
 		c.JSON(http.StatusUnauthorized, gin.H{"authenticated": false})
 	}
@@ -575,23 +778,6 @@ func generateToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// cleanupSessions removes expired sessions periodically
-func cleanupSessions() {
-	ticker := time.NewTicker(1 * time.Hour)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		sessionsMu.Lock()
-		now := time.Now()
-		for token, expiry := range activeSessions {
-			if now.After(expiry) {
-				delete(activeSessions, token)
-			}
-		}
-		sessionsMu.Unlock()
-	}
-}
-
 // setCookieWithSameSite sets a cookie with proper SameSite attribute for ngrok
 func setCookieWithSameSite(c *gin.Context, name, value string, maxAge int, path, domain string, secure, httpOnly bool) {
 	// Build cookie string
@@ -619,49 +805,20 @@ func setCookieWithSameSite(c *gin.Context, name, value string, maxAge int, path,
 	} else {
 		cookie += "; SameSite=Lax"
 	}
-	c.Header("Set-Cookie", cookie)
-}
-
-// getNextOrderID gets the next order ID by finding the highest orderId in the database
-func getNextOrderID(ctx context.Context) (int, error) {
-	// Find the order with the highest orderId
-	findOptions := options.FindOne()
-	findOptions.SetSort(bson.D{primitive.E{Key: "orderId", Value: -1}})
-
-	var highestOrder Order
-	err := ordersCollection.FindOne(ctx, bson.M{}, findOptions).Decode(&highestOrder)
-
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// No orders exist, start from 1
-			return 1, nil
-		}
-		return 0, err
-	}
-
-	// Return the next order ID
-	return highestOrder.OrderID + 1, nil
+	c.Writer.Header().Add("Set-Cookie", cookie)
 }
 
-// loadProductsFromDB loads products from MongoDB or initializes with defaults
+// loadProductsFromDB loads products from the store or initializes with defaults
 func loadProductsFromDB() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := productsCollection.Find(ctx, bson.M{})
+	productsList, err := store.ListProducts(ctx)
 	if err != nil {
 		log.Println("Error loading products from DB, using defaults:", err)
 		initializeDefaultProducts(ctx)
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var productsList []Product
-	if err = cursor.All(ctx, &productsList); err != nil {
-		log.Println("Error decoding products, using defaults:", err)
-		initializeDefaultProducts(ctx)
-		return
-	}
 
 	if len(productsList) == 0 {
 		initializeDefaultProducts(ctx)
@@ -682,23 +839,25 @@ func loadProductsFromDB() {
 // initializeDefaultProducts creates default products if database is empty
 func initializeDefaultProducts(ctx context.Context) {
 	defaultProducts := []Product{
-		{ProductID: 1, Name: "Chocolate Chip Cookies", Description: "Freshly baked cookies with premium chocolate chips", Price: 8.99, Image: "🍪", Category: "Cookies", CreatedAt: time.Now()},
-		{ProductID: 2, Name: "Blueberry Muffins", Description: "Moist muffins bursting with fresh blueberries", Price: 6.99, Image: "🧁", Category: "Muffins", CreatedAt: time.Now()},
-		{ProductID: 3, Name: "Croissant", Description: "Buttery, flaky French croissant", Price: 4.99, Image: "🥐", Category: "Pastries", CreatedAt: time.Now()},
-		{ProductID: 4, Name: "Chocolate Cake", Description: "Rich chocolate layer cake with buttercream frosting", Price: 24.99, Image: "🎂", Category: "Cakes", CreatedAt: time.Now()},
-		{ProductID: 5, Name: "Apple Pie", Description: "Homemade apple pie with cinnamon", Price: 18.99, Image: "🥧", Category: "Pies", CreatedAt: time.Now()},
-		{ProductID: 6, Name: "Bagels", Description: "Fresh New York style bagels (pack of 6)", Price: 7.99, Image: "🥯", Category: "Breads", CreatedAt: time.Now()},
-		{ProductID: 7, Name: "Cinnamon Roll", Description: "Warm cinnamon rolls with cream cheese glaze", Price: 5.99, Image: "🍩", Category: "Pastries", CreatedAt: time.Now()},
-		{ProductID: 8, Name: "Strawberry Tart", Description: "Delicate tart with fresh strawberries", Price: 12.99, Image: "🍓", Category: "Tarts", CreatedAt: time.Now()},
+		{ProductID: 1, Name: "Chocolate Chip Cookies", Description: "Freshly baked cookies with premium chocolate chips", Price: newMoney(899), Image: "🍪", Category: "Cookies", CreatedAt: time.Now()},
+		{ProductID: 2, Name: "Blueberry Muffins", Description: "Moist muffins bursting with fresh blueberries", Price: newMoney(699), Image: "🧁", Category: "Muffins", CreatedAt: time.Now()},
+		{ProductID: 3, Name: "Croissant", Description: "Buttery, flaky French croissant", Price: newMoney(499), Image: "🥐", Category: "Pastries", CreatedAt: time.Now()},
+		{ProductID: 4, Name: "Chocolate Cake", Description: "Rich chocolate layer cake with buttercream frosting", Price: newMoney(2499), Variants: []ProductVariant{
+			{SKU: "CAKE-CHOC-6", Name: `6"`, Price: newMoney(2499), Available: true},
+			{SKU: "CAKE-CHOC-8", Name: `8"`, Price: newMoney(3499), Available: true},
+			{SKU: "CAKE-CHOC-10", Name: `10"`, Price: newMoney(4499), Available: true},
+		}, Image: "🎂", Category: "Cakes", CreatedAt: time.Now()},
+		{ProductID: 5, Name: "Apple Pie", Description: "Homemade apple pie with cinnamon", Price: newMoney(1899), Image: "🥧", Category: "Pies", CreatedAt: time.Now()},
+		{ProductID: 6, Name: "Bagels", Description: "Fresh New York style bagels (pack of 6)", Price: newMoney(799), Image: "🥯", Category: "Breads", CreatedAt: time.Now()},
+		{ProductID: 7, Name: "Cinnamon Roll", Description: "Warm cinnamon rolls with cream cheese glaze", Price: newMoney(599), Image: "🍩", Category: "Pastries", CreatedAt: time.Now()},
+		{ProductID: 8, Name: "Strawberry Tart", Description: "Delicate tart with fresh strawberries", Price: newMoney(1299), Image: "🍓", Category: "Tarts", CreatedAt: time.Now()},
 	}
 
-	var docs []interface{}
-	for _, p := range defaultProducts {
-		p.ID = primitive.NewObjectID()
-		docs = append(docs, p)
+	for i := range defaultProducts {
+		defaultProducts[i].ID = primitive.NewObjectID()
 	}
 
-	_, err := productsCollection.InsertMany(ctx, docs)
+	err := store.InsertProducts(ctx, defaultProducts...)
 	if err != nil {
 		log.Println("Error inserting default products:", err)
 	}
@@ -720,14 +879,32 @@ func createProduct(c *gin.Context) {
 	priceStr := c.PostForm("price")
 	category := c.PostForm("category")
 
-	// Convert price string → float64
-	price, _ := strconv.ParseFloat(priceStr, 64)
+	variants, err := parseVariants(c.PostForm("variants"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Prices are exact decimals, see parseMoney. Products with variants
+	// are priced by variant and show the lowest price.
+	price, err := parseMoney(priceStr)
+	if len(variants) > 0 {
+		price, err = fromPrice(variants), nil
+	}
 
 	// Validate required fields
-	if name == "" || category == "" || price <= 0 {
+	if name == "" || category == "" || err != nil || price.Cents <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Name, category, and valid price are required"})
 		return
 	}
+	if err := checkSKUs(ctx, primitive.NilObjectID, variants); err != nil {
+		if errors.Is(err, ErrSKUExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check SKUs"})
+		return
+	}
 
 	// Handle image upload
 	file, err := c.FormFile("image")
@@ -754,7 +931,7 @@ func createProduct(c *gin.Context) {
 	}
 
 	// Generate productID
-	nextProductID, err := getNextProductID(ctx)
+	nextProductID, err := store.NextSequence(ctx, productIDSequence)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate product ID"})
 		return
@@ -767,14 +944,19 @@ func createProduct(c *gin.Context) {
 		Name:        name,
 		Description: description,
 		Price:       price,
+		Variants:    variants,
 		Image:       imageURL,
 		Category:    category,
 		CreatedAt:   time.Now(),
 	}
 
-	// Save to MongoDB
-	_, err = productsCollection.InsertOne(ctx, product)
-	if err != nil {
+	// Save product
+	if err := store.InsertProducts(ctx, product); err != nil {
+		// Another product took one of the SKUs since checkSKUs
+		if errors.Is(err, ErrSKUExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": skuTakenMessage})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product"})
 		return
 	}
@@ -784,27 +966,10 @@ func createProduct(c *gin.Context) {
 	products = append(products, product)
 	productsMu.Unlock()
 
+	recordAuditChange(c, AuditProductCreated, product.ID.Hex(), nil, product)
 	c.JSON(http.StatusCreated, product)
 }
 
-// getNextProductID gets the next product ID
-func getNextProductID(ctx context.Context) (int, error) {
-	findOptions := options.FindOne()
-	findOptions.SetSort(bson.D{primitive.E{Key: "productId", Value: -1}})
-
-	var highestProduct Product
-	err := productsCollection.FindOne(ctx, bson.M{}, findOptions).Decode(&highestProduct)
-
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return 1, nil
-		}
-		return 0, err
-	}
-
-	return highestProduct.ProductID + 1, nil
-}
-
 // updateProduct updates an existing product
 func updateProduct(c *gin.Context) {
 	id := c.Param("id")
@@ -820,8 +985,53 @@ func updateProduct(c *gin.Context) {
 	priceStr := c.PostForm("price")
 	category := c.PostForm("category")
 
-	// Convert price from string → float
-	price, _ := strconv.ParseFloat(priceStr, 64)
+	// The whole product is replaced, so the required fields are required here too
+	if name == "" || category == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name and category are required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before, err := store.GetProduct(ctx, objectID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product"})
+		return
+	}
+
+	// Sending variants replaces them ("[]" removes them all); leaving the
+	// field out keeps the ones the product has
+	variants := before.Variants
+	if variantsJSON, ok := c.GetPostForm("variants"); ok {
+		if variants, err = parseVariants(variantsJSON); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Prices are exact decimals, see parseMoney. Products with variants
+	// are priced by variant and show the lowest price.
+	price, err := parseMoney(priceStr)
+	if len(variants) > 0 {
+		price, err = fromPrice(variants), nil
+	}
+	if err != nil || price.Cents <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid price is required, e.g. 4.99"})
+		return
+	}
+	if err := checkSKUs(ctx, objectID, variants); err != nil {
+		if errors.Is(err, ErrSKUExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check SKUs"})
+		return
+	}
 
 	// Handle optional image
 	file, err := c.FormFile("image")
@@ -838,34 +1048,34 @@ func updateProduct(c *gin.Context) {
 		imageURL = "/" + filename
 	}
 
-	// Build update object
-	update := bson.M{
-		"$set": bson.M{
-			"name":        name,
-			"description": description,
-			"price":       price,
-			"category":    category,
-		},
-	}
-
-	// Only update the image if new file was uploaded
-	if imageURL != "" {
-		update["$set"].(bson.M)["image"] = imageURL
+	// Build update object; the image only changes if a new file was uploaded
+	update := ProductUpdate{
+		Name:        name,
+		Description: description,
+		Price:       price,
+		Variants:    variants,
+		Category:    category,
+		Image:       imageURL,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	result := productsCollection.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, update)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	if err := store.UpdateProduct(ctx, objectID, update); err != nil {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
+		if errors.Is(err, ErrSKUExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": skuTakenMessage})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
 		return
 	}
 
+	if after, err := store.GetProduct(ctx, objectID); err == nil {
+		recordAuditChange(c, AuditProductUpdated, id, before, after)
+	} else {
+		recordAuditChange(c, AuditProductUpdated, id, before, update)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Product updated successfully"})
 }
 
@@ -881,11 +1091,26 @@ func deleteProduct(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err = productsCollection.DeleteOne(ctx, bson.M{"_id": objectID})
+	before, err := store.GetProduct(ctx, objectID)
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product"})
+		return
+	}
+
+	if err := store.DeleteProduct(ctx, objectID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete product"})
 		return
 	}
 
+	recordAuditChange(c, AuditProductDeleted, id, before, nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestStore points the globals at a fresh memory store holding the
+// default products
+func newTestStore(t *testing.T) {
+	t.Helper()
+	store = newMemoryStore()
+	sessions = store
+	customerSessions = store.CustomerSessions()
+	orderEvents = newEventBroker()
+	productIDCounter = 0
+	loadProductsFromDB()
+}
+
+// newTestServer sets up a test store and returns a router with the order routes
+func newTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	newTestStore(t)
+
+	router := gin.New()
+	api := router.Group("/api")
+	api.POST("/orders", idempotent(), createOrder)
+	api.GET("/orders/:id", requireAuth(PermOrdersRead), getOrder)
+	api.POST("/orders/:id/status", requireAuth(PermOrdersRead), updateOrderStatus)
+	return router
+}
+
+// staffToken creates a staff account with role and returns a session token for it
+func staffToken(t *testing.T, role string) string {
+	t.Helper()
+	user, err := newStaffUser("test-"+role, "Test "+role, role, "password1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	token, _, err := startSession(context.Background(), c, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// doJSON sends body as JSON and returns the response; token, if set, is
+// sent as a bearer token
+func doJSON(router http.Handler, method, path, token string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testOrder is a valid order for two of the default products
+func testOrder() gin.H {
+	return gin.H{
+		"customer": gin.H{"name": "Ann", "phone": "5551234567", "address": "1 Main St"},
+		"items": []gin.H{
+			{"productId": 1, "quantity": 2}, // cookies, 8.99
+			{"productId": 3, "quantity": 1}, // croissant, 4.99
+		},
+	}
+}
+
+// placeOrder creates testOrder and returns it
+func placeOrder(t *testing.T, router http.Handler) Order {
+	t.Helper()
+	w := doJSON(router, http.MethodPost, "/api/orders", "", testOrder())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create order: got %d %s", w.Code, w.Body)
+	}
+	var order Order
+	if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestCreateOrder(t *testing.T) {
+	router := newTestServer(t)
+
+	order := placeOrder(t, router)
+	if order.OrderID != 1 {
+		t.Errorf("orderId = %d, want 1", order.OrderID)
+	}
+	if order.Status != StatusPending {
+		t.Errorf("status = %q, want %q", order.Status, StatusPending)
+	}
+	if order.Total != newMoney(2297) {
+		t.Errorf("total = %v, want 22.97", order.Total)
+	}
+	if len(order.Items) != 2 || order.Items[0].Name != "Chocolate Chip Cookies" || order.Items[0].LineTotal != newMoney(1798) {
+		t.Errorf("items = %+v", order.Items)
+	}
+
+	stored, err := store.GetOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("order was not saved: %v", err)
+	}
+	if stored.Total != order.Total {
+		t.Errorf("stored total = %v, want %v", stored.Total, order.Total)
+	}
+
+	if next := placeOrder(t, router); next.OrderID != 2 {
+		t.Errorf("second orderId = %d, want 2", next.OrderID)
+	}
+}
+
+func TestCreateOrderRejectsInvalidOrders(t *testing.T) {
+	router := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		order gin.H
+		want  int
+	}{
+		{"no items", gin.H{"customer": gin.H{"name": "Ann"}, "items": []gin.H{}}, http.StatusBadRequest},
+		{"unknown fulfillment", gin.H{"fulfillment": "drone", "items": []gin.H{{"productId": 1, "quantity": 1}}}, http.StatusBadRequest},
+		{"unknown product", gin.H{"items": []gin.H{{"productId": 999, "quantity": 1}}}, http.StatusUnprocessableEntity},
+		{"zero quantity", gin.H{"items": []gin.H{{"productId": 1, "quantity": 0}}}, http.StatusUnprocessableEntity},
+		{"variant missing", gin.H{"items": []gin.H{{"productId": 4, "quantity": 1}}}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doJSON(router, http.MethodPost, "/api/orders", "", tt.order)
+			if w.Code != tt.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+
+	orders, err := store.ListOrders(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("%d orders saved, want none", len(orders))
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	router := newTestServer(t)
+	order := placeOrder(t, router)
+	path := "/api/orders/" + order.ID.Hex() + "/status"
+
+	baker := staffToken(t, RoleBaker)
+	driver := staffToken(t, RoleDriver)
+	manager := staffToken(t, RoleManager)
+
+	// Steps run in order against the same order
+	steps := []struct {
+		name   string
+		token  string
+		status string
+		want   int
+	}{
+		{"no login", "", StatusConfirmed, http.StatusUnauthorized},
+		{"unknown status", baker, "eaten", http.StatusBadRequest},
+		{"skipping ahead", baker, StatusBaking, http.StatusConflict},
+		{"driver can't confirm", driver, StatusConfirmed, http.StatusForbidden},
+		{"baker confirms", baker, StatusConfirmed, http.StatusOK},
+		{"baker bakes", baker, StatusBaking, http.StatusOK},
+		{"baker finishes", baker, StatusReady, http.StatusOK},
+		{"baker can't deliver", baker, StatusOutForDelivery, http.StatusForbidden},
+		{"driver leaves", driver, StatusOutForDelivery, http.StatusOK},
+		{"driver delivers", driver, StatusDelivered, http.StatusOK},
+		{"driver can't refund", driver, StatusRefunded, http.StatusForbidden},
+		{"manager refunds", manager, StatusRefunded, http.StatusOK},
+		{"refunded is final", manager, StatusCancelled, http.StatusConflict},
+	}
+	for _, step := range steps {
+		w := doJSON(router, http.MethodPost, path, step.token, gin.H{"status": step.status})
+		if w.Code != step.want {
+			t.Fatalf("%s: got %d %s, want %d", step.name, w.Code, w.Body, step.want)
+		}
+	}
+
+	stored, err := store.GetOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusRefunded {
+		t.Errorf("status = %q, want %q", stored.Status, StatusRefunded)
+	}
+	if stored.DeliveredAt == nil {
+		t.Error("deliveredAt was not set")
+	}
+	wantHistory := []string{StatusPending, StatusConfirmed, StatusBaking, StatusReady, StatusOutForDelivery, StatusDelivered, StatusRefunded}
+	if len(stored.StatusHistory) != len(wantHistory) {
+		t.Fatalf("history has %d changes, want %d", len(stored.StatusHistory), len(wantHistory))
+	}
+	for i, change := range stored.StatusHistory {
+		if change.To != wantHistory[i] {
+			t.Errorf("history[%d] = %q, want %q", i, change.To, wantHistory[i])
+		}
+	}
+	if by := stored.StatusHistory[1].ChangedBy; by != "test-baker" {
+		t.Errorf("confirmed by %q, want test-baker", by)
+	}
+}
+
+func TestUpdateOrderStatusUnknownOrder(t *testing.T) {
+	router := newTestServer(t)
+	token := staffToken(t, RoleOwner)
+
+	w := doJSON(router, http.MethodPost, "/api/orders/000000000000000000000000/status", token, gin.H{"status": StatusConfirmed})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404", w.Code)
+	}
+	w = doJSON(router, http.MethodPost, "/api/orders/not-an-id/status", token, gin.H{"status": StatusConfirmed})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want 400", w.Code)
+	}
+}
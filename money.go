@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shopCurrency is the ISO 4217 code of every price in the shop
+const shopCurrency = "USD"
+
+// currencyDigits is the number of decimal places of a currency's minor
+// unit; currencies not listed have 2
+var currencyDigits = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+var errInvalidMoney = errors.New("amount must be a decimal number like 4.99")
+
+var errWrongCurrency = errors.New("amounts must be in " + shopCurrency)
+
+// Money is an amount in whole minor units (cents for USD), so adding
+// prices and multiplying them by quantities is exact.
+//
+// Rounding rules: amounts typed in with more decimals than the currency has
+// are rejected rather than rounded. Fractions of a cent, from MulFrac (tax)
+// or from the float prices stored before Money existed, are rounded half
+// away from zero.
+//
+// In JSON it is {"amount": "8.99", "cents": 899, "currency": "USD"}:
+// amount is the exact decimal for display, cents the value to compute with.
+type Money struct {
+	Cents    int64  `bson:"cents"`
+	Currency string `bson:"currency"`
+}
+
+// newMoney returns cents minor units of the shop currency
+func newMoney(cents int64) Money {
+	return Money{Cents: cents, Currency: shopCurrency}
+}
+
+// parseMoney parses a decimal amount of the shop currency, such as "4.99"
+// or "12". Negative amounts, exponents and more decimals than the currency
+// has are rejected.
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	digits := newMoney(0).digits()
+	if whole == "" && frac == "" || hasPoint && frac == "" || len(frac) > digits ||
+		!isDigits(whole) || !isDigits(frac) {
+		return Money{}, errInvalidMoney
+	}
+
+	frac += strings.Repeat("0", digits-len(frac))
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, errInvalidMoney
+	}
+	return newMoney(cents), nil
+}
+
+// isDigits reports whether s holds only ASCII digits
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Add returns m + other. Both must be in the same currency; a zero Money
+// takes the currency of the other. Amounts in other currencies are turned
+// away where they come in (UnmarshalJSON, parseVariants, buildOrderItems),
+// so a mismatch here is a bug.
+func (m Money) Add(other Money) Money {
+	switch {
+	case m.Currency == "":
+		m.Currency = other.Currency
+	case other.Currency != "" && other.Currency != m.Currency:
+		panic(fmt.Sprintf("money: adding %s to %s", other.Currency, m.Currency))
+	}
+	m.Cents += other.Cents
+	return m
+}
+
+// Mul returns m times quantity
+func (m Money) Mul(quantity int) Money {
+	m.Cents *= int64(quantity)
+	return m
+}
+
+// MulFrac returns m times num/den, rounded half away from zero to a whole
+// minor unit
+func (m Money) MulFrac(num, den int64) Money {
+	if den < 0 {
+		num, den = -num, -den
+	}
+	n := m.Cents * num
+	if n < 0 {
+		m.Cents = -((-n + den/2) / den)
+	} else {
+		m.Cents = (n + den/2) / den
+	}
+	return m
+}
+
+// Sub returns m - other, see Add
+func (m Money) Sub(other Money) Money {
+	return m.Add(Money{Cents: -other.Cents, Currency: other.Currency})
+}
+
+// IsZero reports whether m is the zero value; the BSON encoder uses it for
+// omitempty
+func (m Money) IsZero() bool {
+	return m == Money{}
+}
+
+// digits returns the number of decimal places of m's currency
+func (m Money) digits() int {
+	if d, ok := currencyDigits[m.Currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// String formats m as a plain decimal, e.g. "8.99"
+func (m Money) String() string {
+	digits := m.digits()
+	sign := ""
+	cents := m.Cents
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	s := strconv.FormatInt(cents, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Cents    int64  `json:"cents"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.String(), Cents: m.Cents, Currency: m.Currency})
+}
+
+// UnmarshalJSON reads cents and currency, or amount when cents is missing;
+// if both are given, cents wins. A plain decimal such as "4.99" (or 4.99)
+// is read with parseMoney, so requests can give amounts the way people
+// write them. Currencies other than the shop's are rejected; a missing one
+// means the shop's.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	// Like the standard types, null leaves m alone
+	if string(data) == "null" {
+		return nil
+	}
+
+	var v struct {
+		Amount   *string `json:"amount"`
+		Cents    *int64  `json:"cents"`
+		Currency string  `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		var s string
+		if json.Unmarshal(data, &s) != nil {
+			s = string(data)
+		}
+		parsed, err := parseMoney(s)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+	if v.Currency == "" {
+		v.Currency = shopCurrency
+	} else if v.Currency != shopCurrency {
+		return errWrongCurrency
+	}
+
+	switch {
+	case v.Cents != nil:
+		*m = Money{Cents: *v.Cents, Currency: v.Currency}
+	case v.Amount != nil:
+		parsed, err := parseMoney(*v.Amount)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	default:
+		return errInvalidMoney
+	}
+	return nil
+}
+
+// percentScale is 100% as a Percent
+const percentScale = 1000000
+
+var errInvalidPercent = errors.New("percentage must be between 0 and 100 with at most 4 decimals, like \"8.875\"")
+
+// Percent is a percentage in millionths, so 8.875% is 88750. In JSON it is
+// the percentage as a string, "8.875".
+type Percent int64
+
+// parsePercent parses a percentage such as "8.875"
+func parsePercent(s string) (Percent, error) {
+	whole, frac, hasPoint := strings.Cut(strings.TrimSpace(s), ".")
+	if whole == "" || hasPoint && frac == "" || len(frac) > 4 || !isDigits(whole) || !isDigits(frac) {
+		return 0, errInvalidPercent
+	}
+	frac += strings.Repeat("0", 4-len(frac))
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || n > percentScale {
+		return 0, errInvalidPercent
+	}
+	return Percent(n), nil
+}
+
+// Of returns p percent of m, rounded like MulFrac
+func (p Percent) Of(m Money) Money {
+	return m.MulFrac(int64(p), percentScale)
+}
+
+// IncludedIn returns the part of m that a p percent surcharge added, e.g.
+// the tax in a tax-inclusive price
+func (p Percent) IncludedIn(m Money) Money {
+	return m.MulFrac(int64(p), percentScale+int64(p))
+}
+
+// String formats p without trailing zeros, e.g. "8.875"
+func (p Percent) String() string {
+	s := strconv.FormatInt(int64(p)/10000, 10)
+	if frac := int64(p) % 10000; frac != 0 {
+		s += "." + strings.TrimRight(fmt.Sprintf("%04d", frac), "0")
+	}
+	return s
+}
+
+func (p Percent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Percent) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Plain numbers are accepted too, e.g. 8.875
+		s = string(data)
+	}
+	parsed, err := parsePercent(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"4.99", 499, false},
+		{"12", 1200, false},
+		{"12.5", 1250, false},
+		{"0.01", 1, false},
+		{".5", 50, false},
+		{"0", 0, false},
+		{" 8.99 ", 899, false},
+		{"1234567.89", 123456789, false},
+		{"4.999", 0, true}, // more decimals than cents are rejected, not rounded
+		{"-1.00", 0, true},
+		{"+1.00", 0, true},
+		{"1e3", 0, true},
+		{"1,50", 0, true},
+		{"4.", 0, true},
+		{".", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in)
+		if tt.wantErr {
+			if !errors.Is(err, errInvalidMoney) {
+				t.Errorf("parseMoney(%q) = %v, %v; want errInvalidMoney", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != newMoney(tt.want) {
+			t.Errorf("parseMoney(%q) = %v, %v; want %d cents", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{newMoney(899), "8.99"},
+		{newMoney(5), "0.05"},
+		{newMoney(0), "0.00"},
+		{newMoney(-150), "-1.50"},
+		{Money{Cents: 1500, Currency: "JPY"}, "1500"},
+		{Money{Cents: 1234, Currency: "KWD"}, "1.234"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%d %s = %q, want %q", tt.m.Cents, tt.m.Currency, got, tt.want)
+		}
+	}
+}
+
+func TestMulFracRounding(t *testing.T) {
+	tests := []struct {
+		cents    int64
+		num, den int64
+		want     int64
+	}{
+		{100, 1, 3, 33},                 // 33.33 rounds down
+		{200, 1, 3, 67},                 // 66.67 rounds up
+		{1, 1, 2, 1},                    // a half rounds away from zero
+		{3, 1, 2, 2},                    // 1.5
+		{5, 1, 2, 3},                    // 2.5, not to even
+		{-1, 1, 2, -1},                  // -0.5
+		{-5, 1, 2, -3},                  // -2.5
+		{1000, 88750, percentScale, 89}, // 8.875% of 10.00 is 88.75 cents
+		{999, -1, 2, -500},              // -499.5
+		{999, 1, -2, -500},              // a negative denominator works the same
+	}
+	for _, tt := range tests {
+		got := newMoney(tt.cents).MulFrac(tt.num, tt.den)
+		if got != newMoney(tt.want) {
+			t.Errorf("%d × %d/%d = %d, want %d", tt.cents, tt.num, tt.den, got.Cents, tt.want)
+		}
+	}
+}
+
+func TestMoneyAdd(t *testing.T) {
+	if got := newMoney(150).Add(newMoney(275)).Sub(newMoney(25)); got != newMoney(400) {
+		t.Errorf("1.50 + 2.75 - 0.25 = %v, want 4.00", got)
+	}
+	if got := (Money{}).Add(newMoney(5)); got != newMoney(5) {
+		t.Errorf("zero + 0.05 = %+v, want 0.05 USD", got)
+	}
+	if got := newMoney(899).Mul(3); got != newMoney(2697) {
+		t.Errorf("8.99 × 3 = %v, want 26.97", got)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(newMoney(2697))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"amount":"26.97","cents":2697,"currency":"USD"}`; string(data) != want {
+		t.Errorf("marshal = %s, want %s", data, want)
+	}
+
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr error
+	}{
+		{`{"amount":"26.97","cents":2697,"currency":"USD"}`, newMoney(2697), nil},
+		{`{"cents":100}`, newMoney(100), nil},
+		{`{"amount":"5.00","currency":"USD"}`, newMoney(500), nil},
+		{`{"amount":"5.00","cents":499}`, newMoney(499), nil},
+		{`{"amount":"5.001"}`, Money{}, errInvalidMoney},
+		{`{"currency":"USD"}`, Money{}, errInvalidMoney},
+		{`{}`, Money{}, errInvalidMoney},
+		{`"4.99"`, newMoney(499), nil},
+		{`4.99`, newMoney(499), nil},
+		{`"4.999"`, Money{}, errInvalidMoney},
+		{`-1`, Money{}, errInvalidMoney},
+		{`{"cents":100,"currency":"EUR"}`, Money{}, errWrongCurrency},
+	}
+	for _, tt := range tests {
+		var got Money
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("unmarshal %s: err = %v, want %v", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("unmarshal %s = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Percent
+		wantErr bool
+	}{
+		{"8.875", 88750, false},
+		{"0", 0, false},
+		{"100", percentScale, false},
+		{"7.25", 72500, false},
+		{"0.0001", 1, false},
+		{"100.01", 0, true},
+		{"1.23456", 0, true},
+		{"-5", 0, true},
+		{"", 0, true},
+		{"5%", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePercent(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePercent(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+		if err == nil && tt.in != "" {
+			if back, _ := parsePercent(got.String()); back != got {
+				t.Errorf("%q formats as %q, which reads back as %d", tt.in, got.String(), back)
+			}
+		}
+	}
+}
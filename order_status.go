@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Order statuses
+const (
+	StatusPending        = "pending"
+	StatusConfirmed      = "confirmed"
+	StatusBaking         = "baking"
+	StatusReady          = "ready"
+	StatusOutForDelivery = "out-for-delivery"
+	StatusPickedUp       = "picked-up"
+	StatusDelivered      = "delivered"
+	StatusCancelled      = "cancelled"
+	StatusRefunded       = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status
+var orderTransitions = map[string][]string{
+	StatusPending:        {StatusConfirmed, StatusCancelled},
+	StatusConfirmed:      {StatusBaking, StatusCancelled},
+	StatusBaking:         {StatusReady, StatusCancelled},
+	StatusReady:          {StatusOutForDelivery, StatusPickedUp, StatusCancelled},
+	StatusOutForDelivery: {StatusDelivered},
+	StatusPickedUp:       {StatusDelivered},
+	StatusDelivered:      {StatusRefunded},
+	StatusCancelled:      {StatusRefunded},
+	StatusRefunded:       {},
+}
+
+// StatusChange records a single status transition of an order
+type StatusChange struct {
+	From      string    `bson:"from" json:"from"`
+	To        string    `bson:"to" json:"to"`
+	ChangedBy string    `bson:"changedBy" json:"changedBy"`
+	ChangedAt time.Time `bson:"changedAt" json:"changedAt"`
+	Note      string    `bson:"note,omitempty" json:"note,omitempty"`
+}
+
+// isOrderStatus reports whether status is a known order status
+func isOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransition reports whether an order may move from one status to another
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// applyStatusChange updates the order's status and appends the change to its history
+func applyStatusChange(order *Order, change StatusChange) {
+	order.Status = change.To
+	order.StatusHistory = append(order.StatusHistory, change)
+	if change.To == StatusDelivered {
+		deliveredAt := change.ChangedAt
+		order.DeliveredAt = &deliveredAt
+	}
+}
+
+// transitionError is returned by changeOrderStatus for a move the state machine does not allow
+type transitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("Cannot change order status from %s to %s", e.From, e.To)
+}
+
+// changeOrderStatus validates and applies a status change made by actor and
+// publishes the resulting order event
+func changeOrderStatus(ctx context.Context, id primitive.ObjectID, to, actor, note string) (Order, error) {
+	order, err := store.GetOrder(ctx, id)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if !canTransition(order.Status, to) {
+		return Order{}, &transitionError{From: order.Status, To: to, Allowed: orderTransitions[order.Status]}
+	}
+
+	change := StatusChange{
+		From:      order.Status,
+		To:        to,
+		ChangedBy: actor,
+		ChangedAt: time.Now(),
+		Note:      note,
+	}
+
+	order, err = store.UpdateOrderStatus(ctx, id, change)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if order.Status == StatusDelivered {
+		orderEvents.Publish(EventOrderDelivered, order)
+	} else {
+		orderEvents.Publish(EventOrderStatusChanged, order)
+	}
+	return order, nil
+}
+
+// auditStatusChange records the latest status change of order, made by
+// actor from ip
+func auditStatusChange(actor, ip string, order Order) {
+	if len(order.StatusHistory) == 0 {
+		return
+	}
+	change := order.StatusHistory[len(order.StatusHistory)-1]
+	saveAudit(AuditEntry{
+		Action:  AuditOrderStatusChanged,
+		Actor:   actor,
+		Target:  order.ID.Hex(),
+		IP:      ip,
+		Details: map[string]interface{}{"orderId": order.OrderID},
+		Before:  map[string]interface{}{"status": change.From},
+		After:   map[string]interface{}{"status": change.To, "note": change.Note},
+	})
+}
+
+// updateOrderStatus moves an order to a new status, e.g. pending → confirmed
+func updateOrderStatus(c *gin.Context) {
+	id := c.Param("id")
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID format"})
+		return
+	}
+
+	var statusReq struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&statusReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !isOrderStatus(statusReq.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status"})
+		return
+	}
+	if !canSetStatus(requestPermissions(c), statusReq.Status) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("You are not allowed to mark orders as %s", statusReq.Status)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, err := changeOrderStatus(ctx, objectID, statusReq.Status, c.GetString("username"), statusReq.Note)
+	if err != nil {
+		var transErr *transitionError
+		switch {
+		case errors.As(err, &transErr):
+			c.JSON(http.StatusConflict, gin.H{"error": transErr.Error(), "allowed": transErr.Allowed})
+		case errors.Is(err, ErrStatusConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "Order status was changed by someone else, please refresh"})
+		case errors.Is(err, ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		}
+		return
+	}
+
+	auditStatusChange(c.GetString("username"), c.ClientIP(), order)
+	c.JSON(http.StatusOK, order)
+}
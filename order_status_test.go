@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{StatusPending, StatusConfirmed, true},
+		{StatusPending, StatusCancelled, true},
+		{StatusPending, StatusBaking, false},
+		{StatusPending, StatusDelivered, false},
+		{StatusConfirmed, StatusBaking, true},
+		{StatusConfirmed, StatusPending, false},
+		{StatusBaking, StatusReady, true},
+		{StatusBaking, StatusCancelled, true},
+		{StatusReady, StatusOutForDelivery, true},
+		{StatusReady, StatusPickedUp, true},
+		{StatusReady, StatusDelivered, false},
+		{StatusOutForDelivery, StatusDelivered, true},
+		{StatusOutForDelivery, StatusCancelled, false},
+		{StatusPickedUp, StatusDelivered, true},
+		{StatusDelivered, StatusRefunded, true},
+		{StatusDelivered, StatusCancelled, false},
+		{StatusCancelled, StatusRefunded, true},
+		{StatusCancelled, StatusConfirmed, false},
+		{StatusRefunded, StatusPending, false},
+		{StatusRefunded, StatusRefunded, false},
+		{StatusPending, StatusPending, false},
+		{"unknown", StatusConfirmed, false},
+		{StatusPending, "unknown", false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestOrderTransitionsOnlyKnownStatuses(t *testing.T) {
+	for from, next := range orderTransitions {
+		for _, to := range next {
+			if !isOrderStatus(to) {
+				t.Errorf("%s can move to unknown status %q", from, to)
+			}
+			if _, ok := statusPermissions[to]; !ok {
+				t.Errorf("no permission guards moving to %q", to)
+			}
+		}
+	}
+}
+
+func TestEveryStatusReachable(t *testing.T) {
+	reached := map[string]bool{StatusPending: true}
+	queue := []string{StatusPending}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, to := range orderTransitions[from] {
+			if !reached[to] {
+				reached[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	for status := range orderTransitions {
+		if !reached[status] {
+			t.Errorf("%s can't be reached from %s", status, StatusPending)
+		}
+	}
+}
+
+func TestApplyStatusChange(t *testing.T) {
+	order := Order{Status: StatusOutForDelivery}
+	change := StatusChange{From: StatusOutForDelivery, To: StatusDelivered, ChangedBy: "sam"}
+	applyStatusChange(&order, change)
+
+	if order.Status != StatusDelivered {
+		t.Errorf("status = %q, want %q", order.Status, StatusDelivered)
+	}
+	if len(order.StatusHistory) != 1 || order.StatusHistory[0] != change {
+		t.Errorf("history = %+v, want the change", order.StatusHistory)
+	}
+	if order.DeliveredAt == nil || !order.DeliveredAt.Equal(change.ChangedAt) {
+		t.Errorf("deliveredAt = %v, want %v", order.DeliveredAt, change.ChangedAt)
+	}
+}
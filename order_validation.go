@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Order limits, configurable through MAX_ITEM_QUANTITY and MAX_ORDER_QUANTITY
+var (
+	maxItemQuantity  = 50
+	maxOrderQuantity = 200
+)
+
+// orderItemRequest is a line item as submitted by the customer
+type orderItemRequest struct {
+	ProductID int    `json:"productId"`
+	SKU       string `json:"sku"` // required for products with variants
+	Quantity  int    `json:"quantity"`
+}
+
+// orderLineError describes why a single line of an order was rejected
+type orderLineError struct {
+	Index     int    `json:"index"`
+	ProductID int    `json:"productId"`
+	SKU       string `json:"sku,omitempty"`
+	Error     string `json:"error"`
+}
+
+// loadOrderLimits reads the order limits from the environment
+func loadOrderLimits() {
+	maxItemQuantity = getEnvInt("MAX_ITEM_QUANTITY", maxItemQuantity)
+	maxOrderQuantity = getEnvInt("MAX_ORDER_QUANTITY", maxOrderQuantity)
+}
+
+// getEnvInt reads a positive integer from the environment, falling back to defaultValue
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// buildOrderItems validates the requested lines against the catalogue and
+// snapshots each product onto its line item. Lines that reference unknown
+// products or variants, unavailable variants or out-of-range quantities
+// are reported in lineErrors.
+func buildOrderItems(ctx context.Context, reqItems []orderItemRequest) (items []OrderItem, lineErrors []orderLineError, err error) {
+	items = make([]OrderItem, 0, len(reqItems))
+	for i, reqItem := range reqItems {
+		lineError := func(msg string) {
+			lineErrors = append(lineErrors, orderLineError{Index: i, ProductID: reqItem.ProductID, SKU: reqItem.SKU, Error: msg})
+		}
+
+		if reqItem.Quantity <= 0 {
+			lineError("Quantity must be at least 1")
+			continue
+		}
+		if reqItem.Quantity > maxItemQuantity {
+			lineError(fmt.Sprintf("Quantity cannot exceed %d", maxItemQuantity))
+			continue
+		}
+
+		product, err := store.GetProductByProductID(ctx, reqItem.ProductID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				lineError("Product not found")
+				continue
+			}
+			return nil, nil, err
+		}
+
+		// Products with variants are priced by the variant ordered
+		var variant ProductVariant
+		unitPrice := product.Price
+		if len(product.Variants) > 0 || reqItem.SKU != "" {
+			var ok bool
+			variant, ok = product.variant(reqItem.SKU)
+			switch {
+			case reqItem.SKU == "":
+				lineError("Choose one of the product's variants by sku")
+				continue
+			case !ok:
+				lineError("Variant not found")
+				continue
+			case !variant.Available:
+				lineError("Variant is not available")
+				continue
+			}
+			unitPrice = variant.Price
+		}
+		// A price edited into the database in another currency can't be
+		// added up with the rest of the order
+		if unitPrice.Currency != shopCurrency {
+			lineError("Product is not priced in " + shopCurrency)
+			continue
+		}
+
+		items = append(items, OrderItem{
+			ProductID: product.ProductID,
+			SKU:       variant.SKU,
+			Quantity:  reqItem.Quantity,
+			Name:      product.Name,
+			Variant:   variant.Name,
+			UnitPrice: unitPrice,
+			Category:  product.Category,
+			LineTotal: unitPrice.Mul(reqItem.Quantity),
+		})
+	}
+	return items, lineErrors, nil
+}
+
+// totalQuantity returns the number of units across all lines
+func totalQuantity(items []OrderItem) int {
+	var n int
+	for _, item := range items {
+		n += item.Quantity
+	}
+	return n
+}
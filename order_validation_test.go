@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBuildOrderItems(t *testing.T) {
+	newTestStore(t)
+	err := store.InsertProducts(context.Background(), Product{
+		ProductID: 100,
+		Name:      "Layer Cake",
+		Price:     newMoney(2000),
+		Variants: []ProductVariant{
+			{SKU: "LAYER-S", Name: "Small", Price: newMoney(2000), Available: true},
+			{SKU: "LAYER-L", Name: "Large", Price: newMoney(3000), Available: false},
+		},
+		Category:  "Cakes",
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		item      orderItemRequest
+		wantError string
+		wantPrice Money
+	}{
+		{"one", orderItemRequest{ProductID: 1, Quantity: 1}, "", newMoney(899)},
+		{"at the limit", orderItemRequest{ProductID: 1, Quantity: maxItemQuantity}, "", newMoney(899)},
+		{"zero", orderItemRequest{ProductID: 1, Quantity: 0}, "Quantity must be at least 1", Money{}},
+		{"negative", orderItemRequest{ProductID: 1, Quantity: -3}, "Quantity must be at least 1", Money{}},
+		{"over the limit", orderItemRequest{ProductID: 1, Quantity: maxItemQuantity + 1}, "Quantity cannot exceed 50", Money{}},
+		{"unknown product", orderItemRequest{ProductID: 999, Quantity: 1}, "Product not found", Money{}},
+		{"variant", orderItemRequest{ProductID: 100, SKU: "layer-s", Quantity: 1}, "", newMoney(2000)},
+		{"no variant chosen", orderItemRequest{ProductID: 100, Quantity: 1}, "Choose one of the product's variants by sku", Money{}},
+		{"unknown variant", orderItemRequest{ProductID: 100, SKU: "LAYER-XL", Quantity: 1}, "Variant not found", Money{}},
+		{"unavailable variant", orderItemRequest{ProductID: 100, SKU: "LAYER-L", Quantity: 1}, "Variant is not available", Money{}},
+		{"sku on a plain product", orderItemRequest{ProductID: 1, SKU: "COOKIE", Quantity: 1}, "Variant not found", Money{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, lineErrors, err := buildOrderItems(context.Background(), []orderItemRequest{tt.item})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantError != "" {
+				if len(lineErrors) != 1 || lineErrors[0].Error != tt.wantError {
+					t.Fatalf("line errors = %+v, want %q", lineErrors, tt.wantError)
+				}
+				if len(items) != 0 {
+					t.Errorf("items = %+v, want none", items)
+				}
+				return
+			}
+			if len(lineErrors) != 0 {
+				t.Fatalf("unexpected line errors %+v", lineErrors)
+			}
+			if len(items) != 1 || items[0].UnitPrice != tt.wantPrice {
+				t.Fatalf("items = %+v, want unit price %v", items, tt.wantPrice)
+			}
+			if want := tt.wantPrice.Mul(tt.item.Quantity); items[0].LineTotal != want {
+				t.Errorf("line total = %v, want %v", items[0].LineTotal, want)
+			}
+		})
+	}
+}
+
+func TestBuildOrderItemsReportsEveryBadLine(t *testing.T) {
+	newTestStore(t)
+
+	_, lineErrors, err := buildOrderItems(context.Background(), []orderItemRequest{
+		{ProductID: 1, Quantity: 0},
+		{ProductID: 2, Quantity: 1},
+		{ProductID: 999, Quantity: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lineErrors) != 2 || lineErrors[0].Index != 0 || lineErrors[1].Index != 2 {
+		t.Errorf("line errors = %+v, want lines 0 and 2", lineErrors)
+	}
+}
+
+func TestBuildOrderItemsUsesConfiguredLimit(t *testing.T) {
+	newTestStore(t)
+	defer func(old int) { maxItemQuantity = old }(maxItemQuantity)
+	maxItemQuantity = 5
+
+	_, lineErrors, err := buildOrderItems(context.Background(), []orderItemRequest{{ProductID: 1, Quantity: 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lineErrors) != 1 || lineErrors[0].Error != "Quantity cannot exceed 5" {
+		t.Errorf("line errors = %+v, want the limit of 5", lineErrors)
+	}
+}
+
+func TestTotalQuantity(t *testing.T) {
+	items := []OrderItem{{Quantity: 2}, {Quantity: 3}, {Quantity: 50}}
+	if got := totalQuantity(items); got != 55 {
+		t.Errorf("totalQuantity = %d, want 55", got)
+	}
+	if got := totalQuantity(nil); got != 0 {
+		t.Errorf("totalQuantity(nil) = %d, want 0", got)
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 50},
+		{"10", 10},
+		{"0", 50},
+		{"-4", 50},
+		{"ten", 50},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_LIMIT", tt.value)
+		if got := getEnvInt("TEST_LIMIT", 50); got != tt.want {
+			t.Errorf("getEnvInt with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
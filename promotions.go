@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Promotion kinds
+const (
+	PromoPercent  = "percent"     // Percent off the targeted lines
+	PromoFixed    = "fixed"       // Amount off the targeted lines
+	PromoBuyXGetY = "buy_x_get_y" // of every BuyQuantity+FreeQuantity targeted units, the cheapest FreeQuantity are free
+	PromoBundle   = "bundle"      // the Bundle products together cost Amount
+)
+
+var (
+	ErrPromotionExists = errors.New("promotion code already exists")
+	ErrPromotionUsedUp = errors.New("promotion usage limit reached")
+)
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// BundleItem is one product of a bundle
+type BundleItem struct {
+	ProductID int `bson:"productId" json:"productId"`
+	Quantity  int `bson:"quantity" json:"quantity"`
+}
+
+// Promotion is a discount. With a Code it is a coupon the customer enters;
+// without one it applies automatically to every order it matches.
+type Promotion struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name string             `bson:"name" json:"name"`
+	Code string             `bson:"code,omitempty" json:"code,omitempty"`
+	Kind string             `bson:"kind" json:"kind"`
+
+	Percent      Percent      `bson:"percent,omitempty" json:"percent,omitempty"`
+	Amount       *Money       `bson:"amount,omitempty" json:"amount,omitempty"` // amount off, or the bundle price
+	BuyQuantity  int          `bson:"buyQuantity,omitempty" json:"buyQuantity,omitempty"`
+	FreeQuantity int          `bson:"freeQuantity,omitempty" json:"freeQuantity,omitempty"`
+	Bundle       []BundleItem `bson:"bundle,omitempty" json:"bundle,omitempty"`
+
+	// Lines the promotion applies to, by category or product; all lines
+	// when both are empty
+	Categories []string `bson:"categories,omitempty" json:"categories,omitempty"`
+	ProductIDs []int    `bson:"productIds,omitempty" json:"productIds,omitempty"`
+
+	MinSpend *Money     `bson:"minSpend,omitempty" json:"minSpend,omitempty"` // order subtotal needed
+	StartsAt *time.Time `bson:"startsAt,omitempty" json:"startsAt,omitempty"`
+	EndsAt   *time.Time `bson:"endsAt,omitempty" json:"endsAt,omitempty"`
+	Weekdays []string   `bson:"weekdays,omitempty" json:"weekdays,omitempty"` // e.g. ["saturday", "sunday"]
+	MaxUses  int        `bson:"maxUses" json:"maxUses"`                       // 0 for no limit
+	Uses     int        `bson:"uses" json:"uses"`
+
+	CreatedBy string    `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// AppliedDiscount is a promotion as applied to an order
+type AppliedDiscount struct {
+	PromotionID string `bson:"promotionId" json:"promotionId"`
+	Name        string `bson:"name" json:"name"`
+	Code        string `bson:"code,omitempty" json:"code,omitempty"`
+	Kind        string `bson:"kind" json:"kind"`
+	Amount      Money  `bson:"amount" json:"amount"`
+}
+
+// couponError is why a coupon can't be used; its message is for the customer
+type couponError struct{ msg string }
+
+func (e couponError) Error() string { return e.msg }
+
+// promotionError is returned by PlaceOrder for a promotion that ran out or
+// was deleted after the order was priced; err is ErrPromotionUsedUp or
+// ErrNotFound
+type promotionError struct {
+	id  primitive.ObjectID
+	err error
+}
+
+func (e promotionError) Error() string { return "promotion " + e.id.Hex() + ": " + e.err.Error() }
+func (e promotionError) Unwrap() error { return e.err }
+
+// promotionUnavailable turns the error of counting a use of promotion id
+// into a promotionError when the promotion can't be used
+func promotionUnavailable(id primitive.ObjectID, err error) error {
+	if errors.Is(err, ErrPromotionUsedUp) || errors.Is(err, ErrNotFound) {
+		return promotionError{id, err}
+	}
+	return err
+}
+
+// normalizeCouponCode returns code the way it is stored
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validate checks p and normalizes its code, weekdays and currencies
+func (p *Promotion) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("Name is required")
+	}
+	if p.Code = normalizeCouponCode(p.Code); p.Code != "" && !couponCodePattern.MatchString(p.Code) {
+		return errors.New("Code must be 3-32 letters, digits, dashes or underscores")
+	}
+
+	switch p.Kind {
+	case PromoPercent:
+		if p.Percent <= 0 {
+			return errors.New("Percent must be more than 0")
+		}
+	case PromoFixed:
+		if p.Amount == nil || p.Amount.Cents <= 0 {
+			return errors.New("Amount must be more than 0")
+		}
+	case PromoBuyXGetY:
+		if p.BuyQuantity < 1 || p.FreeQuantity < 1 {
+			return errors.New("buyQuantity and freeQuantity must be at least 1")
+		}
+	case PromoBundle:
+		if len(p.Bundle) == 0 || p.Amount == nil || p.Amount.Cents <= 0 {
+			return errors.New("A bundle needs its products and a price (amount)")
+		}
+		for _, b := range p.Bundle {
+			if b.ProductID <= 0 || b.Quantity < 1 {
+				return errors.New("Every bundle product needs a productId and a quantity of at least 1")
+			}
+		}
+		if len(p.Categories) > 0 || len(p.ProductIDs) > 0 {
+			return errors.New("Bundles list their products in bundle, not categories or productIds")
+		}
+	default:
+		return errors.New("Kind must be percent, fixed, buy_x_get_y or bundle")
+	}
+
+	for i, day := range p.Weekdays {
+		p.Weekdays[i] = strings.ToLower(strings.TrimSpace(day))
+		if _, ok := weekdays[p.Weekdays[i]]; !ok {
+			return errors.New("Unknown weekday " + day)
+		}
+	}
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		return errors.New("endsAt must be after startsAt")
+	}
+	if p.MaxUses < 0 {
+		return errors.New("maxUses cannot be negative")
+	}
+	for _, m := range []*Money{p.Amount, p.MinSpend} {
+		if m != nil {
+			m.Currency = shopCurrency
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// runsAt reports whether p is on at now, ignoring usage limits
+func (p Promotion) runsAt(now time.Time) bool {
+	if p.StartsAt != nil && now.Before(*p.StartsAt) || p.EndsAt != nil && !now.Before(*p.EndsAt) {
+		return false
+	}
+	if len(p.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range p.Weekdays {
+		if weekdays[day] == now.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// usedUp reports whether p has reached its usage limit
+func (p Promotion) usedUp() bool {
+	return p.MaxUses > 0 && p.Uses >= p.MaxUses
+}
+
+// targets reports whether p applies to item
+func (p Promotion) targets(item OrderItem) bool {
+	if len(p.Categories) == 0 && len(p.ProductIDs) == 0 {
+		return true
+	}
+	if len(p.Categories) > 0 && matchesAny(p.Categories, item.Category) {
+		return true
+	}
+	for _, id := range p.ProductIDs {
+		if id == item.ProductID {
+			return true
+		}
+	}
+	return false
+}
+
+// remaining is what is left of a line's total after earlier discounts
+func remaining(item OrderItem) int64 {
+	return item.LineTotal.Cents - item.Discount.Cents
+}
+
+// discounts works out the cents p takes off each line, on top of the
+// discounts already on them. Nil means p doesn't apply.
+func (p Promotion) discounts(items []OrderItem) []int64 {
+	d := make([]int64, len(items))
+	switch p.Kind {
+	case PromoPercent:
+		for i, item := range items {
+			if p.targets(item) {
+				d[i] = p.Percent.Of(newMoney(remaining(item))).Cents
+			}
+		}
+
+	case PromoFixed:
+		weights := make([]int64, len(items))
+		for i, item := range items {
+			if p.targets(item) {
+				weights[i] = remaining(item)
+			}
+		}
+		d = allocate(p.Amount.Cents, weights)
+
+	case PromoBuyXGetY:
+		// Free units come from the cheapest targeted lines
+		var lines []int
+		units := 0
+		for i, item := range items {
+			if p.targets(item) {
+				lines = append(lines, i)
+				units += item.Quantity
+			}
+		}
+		sort.SliceStable(lines, func(a, b int) bool {
+			return items[lines[a]].UnitPrice.Cents < items[lines[b]].UnitPrice.Cents
+		})
+		free := units / (p.BuyQuantity + p.FreeQuantity) * p.FreeQuantity
+		for _, i := range lines {
+			n := items[i].Quantity
+			if n > free {
+				n = free
+			}
+			d[i] = items[i].UnitPrice.Cents * int64(n)
+			free -= n
+		}
+
+	case PromoBundle:
+		// As many complete bundles as the order holds
+		have := make(map[int]int)
+		price := make(map[int]int64)
+		for _, item := range items {
+			have[item.ProductID] += item.Quantity
+			// Variants can differ in price; count the cheapest
+			if cheapest, ok := price[item.ProductID]; !ok || item.UnitPrice.Cents < cheapest {
+				price[item.ProductID] = item.UnitPrice.Cents
+			}
+		}
+		sets := -1
+		var full int64
+		for _, b := range p.Bundle {
+			if n := have[b.ProductID] / b.Quantity; sets < 0 || n < sets {
+				sets = n
+			}
+			full += price[b.ProductID] * int64(b.Quantity)
+		}
+		saving := int64(sets) * (full - p.Amount.Cents)
+		if saving <= 0 {
+			return nil
+		}
+		weights := make([]int64, len(items))
+		for i, item := range items {
+			for _, b := range p.Bundle {
+				if b.ProductID == item.ProductID {
+					weights[i] = remaining(item)
+				}
+			}
+		}
+		d = allocate(saving, weights)
+	}
+
+	var total int64
+	for i := range d {
+		if r := remaining(items[i]); d[i] > r {
+			d[i] = r
+		}
+		total += d[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	return d
+}
+
+// allocate splits amount across lines in proportion to weights, in whole
+// cents, never giving a line more than its weight. Cents left over from
+// rounding down go to the first lines with room.
+func allocate(amount int64, weights []int64) []int64 {
+	var sum int64
+	for _, w := range weights {
+		sum += w
+	}
+	if amount > sum {
+		amount = sum
+	}
+	shares := make([]int64, len(weights))
+	if sum == 0 {
+		return shares
+	}
+	left := amount
+	for i, w := range weights {
+		shares[i] = amount * w / sum
+		left -= shares[i]
+	}
+	for i := 0; left > 0; i++ {
+		if shares[i] < weights[i] {
+			shares[i]++
+			left--
+		}
+		if i == len(weights)-1 {
+			i = -1
+		}
+	}
+	return shares
+}
+
+// Pricing is what an order costs once promotions and tax are applied
+type Pricing struct {
+	Subtotal  Money             `json:"subtotal"` // before discounts and tax
+	Discount  Money             `json:"discount"`
+	Tax       Money             `json:"tax"`
+	Total     Money             `json:"total"`
+	Discounts []AppliedDiscount `json:"discounts"`
+	Items     []OrderItem       `json:"items"`
+
+	applied []Promotion // to count as used when the order is placed
+}
+
+// priceOrder applies the running automatic promotions, then the coupon
+// with code (if any), then tax to items, setting each line's discount and
+// tax. Problems with the coupon are couponErrors.
+func priceOrder(ctx context.Context, items []OrderItem, code, fulfillment string, customer Customer) (Pricing, error) {
+	promotions, err := store.ListPromotions(ctx)
+	if err != nil {
+		return Pricing{}, err
+	}
+	now := time.Now()
+
+	var subtotal int64
+	for i := range items {
+		items[i].Discount = newMoney(0)
+		subtotal += items[i].LineTotal.Cents
+	}
+	eligible := func(p Promotion) bool {
+		return p.MinSpend == nil || subtotal >= p.MinSpend.Cents
+	}
+
+	var applicable []Promotion
+	for _, p := range promotions {
+		if p.Code == "" && p.runsAt(now) && !p.usedUp() && eligible(p) {
+			applicable = append(applicable, p)
+		}
+	}
+
+	// The coupon goes last, on what the automatic promotions left
+	if code = normalizeCouponCode(code); code != "" {
+		var coupon *Promotion
+		for i := range promotions {
+			if promotions[i].Code == code {
+				coupon = &promotions[i]
+			}
+		}
+		switch {
+		case coupon == nil:
+			return Pricing{}, couponError{"Unknown coupon code"}
+		case !coupon.runsAt(now):
+			return Pricing{}, couponError{"This coupon has expired or isn't valid right now"}
+		case coupon.usedUp():
+			return Pricing{}, couponError{"This coupon has been used up"}
+		case !eligible(*coupon):
+			return Pricing{}, couponError{"Spend at least " + coupon.MinSpend.String() + " " + shopCurrency + " to use this coupon"}
+		}
+		applicable = append(applicable, *coupon)
+	}
+
+	pricing := Pricing{Discount: newMoney(0), Discounts: []AppliedDiscount{}}
+	for _, p := range applicable {
+		d := p.discounts(items)
+		if d == nil {
+			if p.Code != "" {
+				return Pricing{}, couponError{"This coupon doesn't apply to anything in the order"}
+			}
+			continue
+		}
+		applied := AppliedDiscount{PromotionID: p.ID.Hex(), Name: p.Name, Code: p.Code, Kind: p.Kind, Amount: newMoney(0)}
+		for i, cents := range d {
+			items[i].Discount = items[i].Discount.Add(newMoney(cents))
+			applied.Amount = applied.Amount.Add(newMoney(cents))
+		}
+		pricing.Discount = pricing.Discount.Add(applied.Amount)
+		pricing.Discounts = append(pricing.Discounts, applied)
+		pricing.applied = append(pricing.applied, p)
+	}
+
+	pricing.Subtotal, pricing.Tax, pricing.Total = applyTax(taxConfig, items, fulfillment, customer)
+	pricing.Items = items
+	return pricing, nil
+}
+
+// appliedIDs returns the IDs of the promotions to count as used
+func (p Pricing) appliedIDs() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(p.applied))
+	for _, promotion := range p.applied {
+		ids = append(ids, promotion.ID)
+	}
+	return ids
+}
+
+// validateCoupon prices a cart with a coupon, so the cart can show the
+// discount before checkout
+func validateCoupon(c *gin.Context) {
+	var req struct {
+		Code        string             `json:"code" binding:"required"`
+		Items       []orderItemRequest `json:"items"`
+		Fulfillment string             `json:"fulfillment"`
+		Customer    Customer           `json:"customer"` // only region is used, for tax
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+	if len(req.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The cart is empty"})
+		return
+	}
+	if req.Fulfillment == "" {
+		req.Fulfillment = defaultFulfillment
+	}
+	if !isFulfillment(req.Fulfillment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Fulfillment must be dine_in, takeaway or delivery"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	items, lineErrors, err := buildOrderItems(ctx, req.Items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	if len(lineErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cart contains invalid items", "items": lineErrors})
+		return
+	}
+
+	pricing, err := priceOrder(ctx, items, req.Code, req.Fulfillment, req.Customer)
+	if err != nil {
+		var couponErr couponError
+		if errors.As(err, &couponErr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"valid": false, "error": couponErr.msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check coupon"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": true, "code": normalizeCouponCode(req.Code), "pricing": pricing})
+}
+
+// getPromotions lists all promotions and coupons
+func getPromotions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	promotions, err := store.ListPromotions(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promotions"})
+		return
+	}
+	c.JSON(http.StatusOK, promotions)
+}
+
+// createPromotion adds a promotion or coupon
+func createPromotion(c *gin.Context) {
+	var promotion Promotion
+	if err := c.ShouldBindJSON(&promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promotion: " + err.Error()})
+		return
+	}
+	if err := promotion.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	promotion.ID = primitive.NewObjectID()
+	promotion.Uses = 0
+	promotion.CreatedBy = c.GetString("username")
+	promotion.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.InsertPromotion(ctx, promotion); err != nil {
+		if errors.Is(err, ErrPromotionExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A coupon with this code already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save promotion"})
+		return
+	}
+
+	recordAuditChange(c, AuditPromotionCreated, promotion.ID.Hex(), nil, promotion)
+	c.JSON(http.StatusCreated, promotion)
+}
+
+// updatePromotion replaces a promotion's terms; its use count is kept
+func updatePromotion(c *gin.Context) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promotion ID format"})
+		return
+	}
+	var promotion Promotion
+	if err := c.ShouldBindJSON(&promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promotion: " + err.Error()})
+		return
+	}
+	if err := promotion.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before, err := store.GetPromotion(ctx, objectID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promotion"})
+		return
+	}
+	promotion.ID = before.ID
+	promotion.Uses = before.Uses
+	promotion.CreatedBy = before.CreatedBy
+	promotion.CreatedAt = before.CreatedAt
+
+	if err := store.UpdatePromotion(ctx, promotion); err != nil {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+		case errors.Is(err, ErrPromotionExists):
+			c.JSON(http.StatusConflict, gin.H{"error": "A coupon with this code already exists"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promotion"})
+		}
+		return
+	}
+
+	recordAuditChange(c, AuditPromotionUpdated, promotion.ID.Hex(), before, promotion)
+	c.JSON(http.StatusOK, promotion)
+}
+
+// deletePromotion ends a promotion; orders keep the discounts they got
+func deletePromotion(c *gin.Context) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promotion ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before, err := store.GetPromotion(ctx, objectID)
+	if err == nil {
+		err = store.DeletePromotion(ctx, objectID)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete promotion"})
+		return
+	}
+
+	recordAuditChange(c, AuditPromotionDeleted, objectID.Hex(), before, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion deleted"})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{"even split", 300, []int64{500, 500, 500}, []int64{100, 100, 100}},
+		{"proportional", 1000, []int64{300, 700}, []int64{300, 700}},
+		{"remainder to the first line", 100, []int64{100, 100, 100}, []int64{34, 33, 33}},
+		{"remainder spread over lines", 2, []int64{1, 1, 1}, []int64{1, 1, 0}},
+		{"remainder skips full lines", 7, []int64{1, 100}, []int64{1, 6}},
+		{"remainder skips untargeted lines", 3, []int64{0, 2, 2}, []int64{0, 2, 1}},
+		{"more than the lines are worth", 2000, []int64{300, 700}, []int64{300, 700}},
+		{"nothing to split", 0, []int64{300, 700}, []int64{0, 0}},
+		{"no weight", 500, []int64{0, 0}, []int64{0, 0}},
+		{"no lines", 500, nil, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allocate(tt.amount, tt.weights)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("allocate(%d, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+			}
+
+			var sum, weights int64
+			for i, share := range got {
+				if share < 0 || share > tt.weights[i] {
+					t.Errorf("line %d gets %d of its %d", i, share, tt.weights[i])
+				}
+				sum += share
+				weights += tt.weights[i]
+			}
+			if want := min(tt.amount, weights); sum != want {
+				t.Errorf("shares add up to %d, want %d", sum, want)
+			}
+		})
+	}
+}
+
+func TestFixedDiscountSplitAcrossLines(t *testing.T) {
+	amount := newMoney(100)
+	promotion := Promotion{Kind: PromoFixed, Amount: &amount, Categories: []string{"Cookies"}}
+	items := []OrderItem{
+		{Category: "Cookies", LineTotal: newMoney(100)},
+		{Category: "Breads", LineTotal: newMoney(500)},
+		{Category: "Cookies", LineTotal: newMoney(100), Discount: newMoney(50)},
+		{Category: "Cookies", LineTotal: newMoney(150)},
+	}
+
+	// Targeted lines have 1.00, 0.50 and 1.50 left, so 1.00 off splits 1:0.5:1.5
+	want := []int64{34, 0, 16, 50}
+	if got := promotion.discounts(items); !reflect.DeepEqual(got, want) {
+		t.Errorf("discounts = %v, want %v", got, want)
+	}
+}
+
+func TestCouponMinSpend(t *testing.T) {
+	newTestStore(t)
+	minSpend, amount := newMoney(2500), newMoney(500)
+	coupon := Promotion{ID: primitive.NewObjectID(), Name: "Five off", Code: "SAVE5", Kind: PromoFixed, Amount: &amount, MinSpend: &minSpend}
+	if err := store.InsertPromotion(context.Background(), coupon); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []OrderItem{{Category: "Cookies", LineTotal: newMoney(1000)}}
+	_, err := priceOrder(context.Background(), items, "save5", FulfillmentDineIn, Customer{})
+	var couponErr couponError
+	if !errors.As(err, &couponErr) || couponErr.msg != "Spend at least 25.00 USD to use this coupon" {
+		t.Errorf("err = %v, want the minimum spend in USD", err)
+	}
+
+	items = []OrderItem{{Category: "Cookies", LineTotal: newMoney(2500)}}
+	pricing, err := priceOrder(context.Background(), items, "save5", FulfillmentDineIn, Customer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pricing.Discount != amount {
+		t.Errorf("discount = %v, want 5.00", pricing.Discount)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// sessionIdleTimeout logs a session out after this long without
+	// requests, set with SESSION_IDLE_TIMEOUT
+	sessionIdleTimeout = 24 * time.Hour
+
+	// sessionMaxAge is how long a session lasts at most, however active it
+	// is, set with SESSION_MAX_AGE
+	sessionMaxAge = 30 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often a request writes the new
+	// last-seen time of its session to the store
+	sessionTouchInterval = time.Minute
+)
+
+// Session is a staff login on one device. The token itself is never
+// stored; ID is its SHA-256 hash.
+type Session struct {
+	ID         string    `bson:"_id" json:"id"`
+	Username   string    `bson:"username" json:"username"`
+	Role       string    `bson:"role" json:"role"`
+	UserAgent  string    `bson:"userAgent" json:"userAgent"`
+	IP         string    `bson:"ip" json:"ip"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+	LastSeenAt time.Time `bson:"lastSeenAt" json:"lastSeenAt"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+
+	// TwoFactorPending marks the challenge between the password and the
+	// code of a two-factor login. It doesn't authenticate any requests.
+	TwoFactorPending bool `bson:"twoFactorPending,omitempty" json:"-"`
+}
+
+// SessionStore keeps login sessions, so they survive restarts and can be
+// shared between instances. GetSession and DeleteSession return
+// ErrNotFound for unknown sessions; expired sessions may still be returned
+// until DeleteExpiredSessions removes them.
+type SessionStore interface {
+	InsertSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, id string) (Session, error)
+	// TouchSession records activity on a session and moves its expiry
+	TouchSession(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error
+	// ListSessions returns username's sessions, most recently used first
+	ListSessions(ctx context.Context, username string) ([]Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions removes all of username's sessions except the one
+	// with ID exceptID, if given, and returns how many were removed
+	DeleteUserSessions(ctx context.Context, username, exceptID string) (int, error)
+	DeleteExpiredSessions(ctx context.Context, now time.Time) error
+}
+
+// sessionView is a session as listed by the session management API
+type sessionView struct {
+	Session
+	Current bool `json:"current"` // the session making the request
+}
+
+// loadSessionConfig reads the session lifetimes from the environment
+func loadSessionConfig() {
+	for _, setting := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"SESSION_IDLE_TIMEOUT", &sessionIdleTimeout},
+		{"SESSION_MAX_AGE", &sessionMaxAge},
+	} {
+		value := getEnv(setting.env, "")
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Printf("Ignoring invalid %s=%q, using %s", setting.env, value, *setting.value)
+			continue
+		}
+		*setting.value = d
+	}
+}
+
+// sessionID returns the ID a session token is stored under
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionExpiry is when a session created at createdAt and last used at
+// lastSeenAt expires
+func sessionExpiry(createdAt, lastSeenAt time.Time) time.Time {
+	expiresAt := lastSeenAt.Add(sessionIdleTimeout)
+	if limit := createdAt.Add(sessionMaxAge); expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
+}
+
+// startSession logs user in on the device making the request and returns
+// the new session token
+func startSession(ctx context.Context, c *gin.Context, user StaffUser) (string, Session, error) {
+	return insertSession(ctx, c, sessions, user.Username, user.Role, false)
+}
+
+// startTwoFactorChallenge records that user has given the right password
+// and returns the challenge token for the second login step
+func startTwoFactorChallenge(ctx context.Context, c *gin.Context, user StaffUser) (string, error) {
+	token, _, err := insertSession(ctx, c, sessions, user.Username, user.Role, true)
+	return token, err
+}
+
+// insertSession starts a session in ss, the staff or customer sessions
+func insertSession(ctx context.Context, c *gin.Context, ss SessionStore, username, role string, twoFactorPending bool) (string, Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	now := time.Now()
+	session := Session{
+		ID:         sessionID(token),
+		Username:   username,
+		Role:       role,
+		UserAgent:  userAgent,
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  sessionExpiry(now, now),
+
+		TwoFactorPending: twoFactorPending,
+	}
+	if twoFactorPending {
+		session.ExpiresAt = now.Add(twoFactorChallengeTTL)
+	}
+	if err := ss.InsertSession(ctx, session); err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// lookupSession returns the session for token from ss. Unknown and expired
+// sessions give ErrNotFound.
+func lookupSession(ss SessionStore, token string) (Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := ss.GetSession(ctx, sessionID(token))
+	if err != nil {
+		return Session{}, err
+	}
+	if session.TwoFactorPending || time.Now().After(session.ExpiresAt) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+// lookupStaffSession is lookupSession for staff logins. Sessions without a
+// staff role, such as customer sessions kept here by older versions, give
+// ErrNotFound.
+func lookupStaffSession(token string) (Session, error) {
+	session, err := lookupSession(sessions, token)
+	if err == nil && !isRole(session.Role) {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+// touchSession extends the session after activity. Writes are limited to
+// one per sessionTouchInterval; failures only shorten the session, so they
+// are logged and otherwise ignored.
+func touchSession(ss SessionStore, session Session) {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ss.TouchSession(ctx, session.ID, now, sessionExpiry(session.CreatedAt, now))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to update session of %s: %v", session.Username, err)
+	}
+}
+
+// endSession logs out the session for token in ss, if there is one
+func endSession(ss SessionStore, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ss.DeleteSession(ctx, sessionID(token))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// revokeUserSessions logs username out of every session
+func revokeUserSessions(username string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := sessions.DeleteUserSessions(ctx, username, ""); err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", username, err)
+	}
+}
+
+// cleanupSessions removes expired sessions periodically. MongoDB also
+// drops them on its own through a TTL index.
+func cleanupSessions() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		for _, ss := range []SessionStore{sessions, customerSessions} {
+			if err := ss.DeleteExpiredSessions(ctx, time.Now()); err != nil {
+				log.Println("Failed to remove expired sessions:", err)
+			}
+		}
+		cancel()
+	}
+}
+
+// listSessionViews returns username's unexpired sessions, marking currentID
+func listSessionViews(ctx context.Context, username, currentID string) ([]sessionView, error) {
+	userSessions, err := sessions.ListSessions(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	views := []sessionView{}
+	for _, session := range userSessions {
+		if session.TwoFactorPending || now.After(session.ExpiresAt) {
+			continue
+		}
+		views = append(views, sessionView{Session: session, Current: session.ID == currentID})
+	}
+	return views, nil
+}
+
+// getMySessions lists the devices the logged-in user is signed in on
+func getMySessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	views, err := listSessionViews(ctx, c.GetString("username"), c.GetString("sessionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// revokeMySession logs the logged-in user out of one of their sessions
+func revokeMySession(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Other users' sessions look the same as unknown ones
+	session, err := sessions.GetSession(ctx, c.Param("id"))
+	if err == nil && session.Username != c.GetString("username") {
+		err = ErrNotFound
+	}
+	if err == nil {
+		err = sessions.DeleteSession(ctx, session.ID)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	if session.ID == c.GetString("sessionID") {
+		isSecure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+		setCookieWithSameSite(c, "auth_token", "", -1, "/", "", isSecure, true)
+		setCSRFCookie(c, csrfCookie, "", -1)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// revokeOtherSessions logs the logged-in user out everywhere except the
+// session making the request
+func revokeOtherSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n, err := sessions.DeleteUserSessions(ctx, c.GetString("username"), c.GetString("sessionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Other sessions revoked", "revoked": n})
+}
+
+// getUserSessions lists the devices a staff member is signed in on
+func getUserSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	views, err := listSessionViews(ctx, normalizeUsername(c.Param("username")), c.GetString("sessionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// forceLogoutUser logs a staff member out of every session
+func forceLogoutUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := normalizeUsername(c.Param("username"))
+	if _, err := store.GetUser(ctx, username); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	n, err := sessions.DeleteUserSessions(ctx, username, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	recordAudit(c, AuditUserLoggedOut, username, map[string]interface{}{"revoked": n})
+	c.JSON(http.StatusOK, gin.H{"message": "User logged out everywhere", "revoked": n})
+}
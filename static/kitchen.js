@@ -0,0 +1,141 @@
+// Kitchen display: shows tickets that still need work and lets staff
+// acknowledge and bump them over a WebSocket shared with other displays.
+
+let tickets = [];
+let socket = null;
+let reconnectDelay = 1000;
+
+// Statuses that are still the kitchen's responsibility
+const KITCHEN_STATUSES = ['pending', 'confirmed', 'baking'];
+
+// Label for the bump button, by current status
+const BUMP_LABELS = {
+    'pending': 'Ack',
+    'confirmed': 'Start Baking',
+    'baking': 'Mark Ready'
+};
+
+document.addEventListener('DOMContentLoaded', async () => {
+    const response = await fetch('/api/auth/check', { headers: { 'ngrok-skip-browser-warning': '1' } });
+    const data = await response.json();
+    if (!data.authenticated) {
+        // Log in on the orders page first
+        window.location.href = '/orders';
+        return;
+    }
+    await loadTickets();
+    connect();
+});
+
+// Load the current tickets
+async function loadTickets() {
+    const response = await fetch('/api/orders', { headers: { 'ngrok-skip-browser-warning': '1' } });
+    if (!response.ok) {
+        return;
+    }
+    const orders = await response.json();
+    tickets = orders.filter(o => KITCHEN_STATUSES.includes(o.status));
+    render();
+}
+
+// Open the WebSocket, reconnecting with backoff when it drops
+function connect() {
+    const scheme = window.location.protocol === 'https:' ? 'wss' : 'ws';
+    socket = new WebSocket(`${scheme}://${window.location.host}/api/kitchen/ws`);
+
+    socket.onopen = () => {
+        reconnectDelay = 1000;
+        setConnectionStatus('Live');
+        // Catch up on anything missed while disconnected
+        loadTickets();
+    };
+
+    socket.onmessage = (e) => handleMessage(JSON.parse(e.data));
+
+    socket.onclose = (e) => {
+        setConnectionStatus(e.reason ? `Disconnected: ${e.reason}` : 'Reconnecting...');
+        if (e.reason === 'session expired') {
+            window.location.href = '/orders';
+            return;
+        }
+        setTimeout(connect, reconnectDelay);
+        reconnectDelay = Math.min(reconnectDelay * 2, 30000);
+    };
+}
+
+// Apply a message from the server
+function handleMessage(msg) {
+    switch (msg.type) {
+    case 'order.created':
+    case 'order.status_changed':
+    case 'order.delivered': {
+        const order = msg.order;
+        tickets = tickets.filter(t => t.id !== order.id);
+        if (KITCHEN_STATUSES.includes(order.status)) {
+            tickets.push(order);
+            tickets.sort((a, b) => a.orderId - b.orderId);
+        }
+        render();
+        break;
+    }
+    case 'resync':
+        loadTickets();
+        break;
+    case 'error':
+        alert(msg.error);
+        break;
+    }
+}
+
+// Move a ticket to its next kitchen stage
+function bump(orderMongoId) {
+    if (socket && socket.readyState === WebSocket.OPEN) {
+        socket.send(JSON.stringify({ type: 'bump', orderId: orderMongoId }));
+    }
+}
+
+function setConnectionStatus(text) {
+    document.getElementById('connection-status').textContent = text;
+}
+
+function render() {
+    const container = document.getElementById('orders-container');
+    if (tickets.length === 0) {
+        container.innerHTML = `
+            <div class="empty-orders">
+                <h3>All Caught Up</h3>
+                <p>New orders will appear here as they come in.</p>
+            </div>
+        `;
+        return;
+    }
+
+    container.innerHTML = tickets.map(order => {
+        const items = order.items.map(item => `
+            <li class="order-item-row">
+                <div class="order-item-details">
+                    <div class="order-item-name">${item.name || `Product #${item.productId}`}${item.variant ? ` (${item.variant})` : ''}</div>
+                </div>
+                <div class="order-item-total">× ${item.quantity}</div>
+            </li>
+        `).join('');
+
+        return `
+            <div class="order-ticket ${order.status}">
+                <div class="order-ticket-header">
+                    <div class="order-header-info">
+                        <div class="order-id-large">Order #${order.orderId}</div>
+                        <div class="order-date">${new Date(order.createdAt).toLocaleTimeString()}</div>
+                    </div>
+                    <div class="order-status ${order.status}">${order.status}</div>
+                </div>
+                <div class="order-items">
+                    <ul class="order-item-list">${items}</ul>
+                </div>
+                <div class="order-actions">
+                    <button class="status-btn ${order.status}" onclick="bump('${order.id}')">${BUMP_LABELS[order.status]}</button>
+                </div>
+            </div>
+        `;
+    }).join('');
+}
@@ -2,6 +2,51 @@
 let orders = [];
 let products = [];
 let authToken = null;
+let orderEvents = null;
+let permissions = [];
+
+// Statuses an order may move to next (mirrors orderTransitions in order_status.go)
+const ORDER_TRANSITIONS = {
+    'pending': ['confirmed', 'cancelled'],
+    'confirmed': ['baking', 'cancelled'],
+    'baking': ['ready', 'cancelled'],
+    'ready': ['out-for-delivery', 'picked-up', 'cancelled'],
+    'out-for-delivery': ['delivered'],
+    'picked-up': ['delivered'],
+    'delivered': ['refunded'],
+    'cancelled': ['refunded'],
+    'refunded': []
+};
+
+// Button labels for each target status
+const STATUS_ACTIONS = {
+    'confirmed': 'Confirm',
+    'baking': 'Start Baking',
+    'ready': 'Mark Ready',
+    'out-for-delivery': 'Out for Delivery',
+    'picked-up': 'Picked Up',
+    'delivered': '✓ Mark as Delivered',
+    'cancelled': 'Cancel',
+    'refunded': 'Refund'
+};
+
+// Permission needed to move an order into each status (mirrors statusPermissions in users.go)
+const STATUS_PERMISSIONS = {
+    'confirmed': 'orders:confirm',
+    'baking': 'orders:prepare',
+    'ready': 'orders:prepare',
+    'out-for-delivery': 'orders:deliver',
+    'picked-up': 'orders:deliver',
+    'delivered': 'orders:deliver',
+    'cancelled': 'orders:cancel',
+    'refunded': 'orders:refund'
+};
+
+// Format whole cents for display, e.g. 899 → "8.99". Prices arrive as
+// {amount, cents, currency}; add cents, never amounts.
+function formatCents(cents) {
+    return (cents / 100).toFixed(2);
+}
 
 // Helper function to create fetch options with ngrok header
 function getFetchOptions(method = 'GET', body = null, includeAuth = false) {
@@ -59,6 +104,7 @@ async function checkAuthentication() {
         if (data.authenticated) {
             // Get token from cookie or localStorage
             authToken = getAuthToken();
+            permissions = data.permissions || [];
             showOrdersPage();
         } else {
             showLoginModal();
@@ -85,6 +131,7 @@ function getAuthToken() {
 
 // Show login modal
 function showLoginModal() {
+    disconnectOrderEvents();
     document.getElementById('login-modal').style.display = 'flex';
     document.getElementById('orders-section').style.display = 'none';
 }
@@ -94,6 +141,7 @@ function showOrdersPage() {
     document.getElementById('login-modal').style.display = 'none';
     document.getElementById('orders-section').style.display = 'block';
     loadOrders();
+    connectOrderEvents();
 }
 
 // Handle login
@@ -118,6 +166,7 @@ async function handleLogin(e) {
         // Store token
         authToken = data.token;
         localStorage.setItem('auth_token', data.token);
+        permissions = data.permissions || [];
 
         // Hide login modal and show orders
         showOrdersPage();
@@ -216,11 +265,14 @@ function createOrderTicket(order) {
     // Get product details for items with images and prices
     // Get product details for items with images and prices
     const itemsHtml = order.items.map(item => {
+        // Prefer the name and price captured when the order was placed
         const product = products.find(p => p.productId === item.productId);
-        const productName = product ? product.name : `Product #${item.productId}`;
+        const baseName = item.name || (product ? product.name : `Product #${item.productId}`);
+        const productName = item.variant ? `${baseName} (${item.variant})` : baseName;
         const productImage = product ? product.image : '📦';
-        const productPrice = product ? product.price : 0;
-        const itemTotal = productPrice * item.quantity;
+        // Amounts are in cents, see formatCents
+        const unitCents = item.name ? item.unitPrice.cents : (product ? product.price.cents : 0);
+        const totalCents = item.name ? item.lineTotal.cents : unitCents * item.quantity;
 
         // Determine image display format
         let imageDisplay = '';
@@ -247,22 +299,25 @@ function createOrderTicket(order) {
             <div class="order-item-details">
                 <div class="order-item-name">${productName}</div>
                 <div class="order-item-price-info">
-                    <span class="order-item-unit-price">$${productPrice.toFixed(2)} each</span>
+                    <span class="order-item-unit-price">$${formatCents(unitCents)} each</span>
                     <span class="order-item-quantity">× ${item.quantity}</span>
                 </div>
             </div>
-            <div class="order-item-total">$${itemTotal.toFixed(2)}</div>
+            <div class="order-item-total">$${formatCents(totalCents)}</div>
         </li>
     `;
     }).join('');
 
 
-    // Only show delivered button if order is not already delivered and we have a valid MongoDB ID
-    const deliveredButton = (statusClass !== 'delivered' && orderMongoId) ? `
-        <button class="delivered-btn" onclick="markAsDelivered('${orderMongoId}', ${orderId})">
-            ✓ Mark as Delivered
+    // One button per status the order may move to next that this role may set
+    const nextStatuses = orderMongoId
+        ? (ORDER_TRANSITIONS[order.status] || []).filter(status => permissions.includes(STATUS_PERMISSIONS[status]))
+        : [];
+    const statusButtons = nextStatuses.map(status => `
+        <button class="status-btn ${status}" onclick="updateOrderStatus('${orderMongoId}', ${orderId}, '${status}')">
+            ${STATUS_ACTIONS[status]}
         </button>
-    ` : '';
+    `).join('');
 
     return `
         <div class="order-ticket ${statusClass}">
@@ -279,9 +334,27 @@ function createOrderTicket(order) {
                     <span class="summary-label">Items:</span>
                     <span class="summary-value">${order.items.length}</span>
                 </div>
+                <div class="order-summary-item">
+                    <span class="summary-label">Subtotal:</span>
+                    <span class="summary-value">$${order.subtotal.amount}</span>
+                </div>
+                ${order.discount && order.discount.cents ? `
+                <div class="order-summary-item">
+                    <span class="summary-label">Discount${order.couponCode ? ' (' + order.couponCode + ')' : ''}:</span>
+                    <span class="summary-value">-$${order.discount.amount}</span>
+                </div>
+                ${(order.discounts || []).map(d => `
+                <div class="order-summary-item">
+                    <span class="summary-label">&nbsp;&nbsp;${d.name}</span>
+                    <span class="summary-value">-$${d.amount.amount}</span>
+                </div>`).join('')}` : ''}
+                <div class="order-summary-item">
+                    <span class="summary-label">Tax${order.taxIncluded ? ' (included)' : ''}:</span>
+                    <span class="summary-value">$${order.tax.amount}</span>
+                </div>
                 <div class="order-summary-item">
                     <span class="summary-label">Total Amount:</span>
-                    <span class="summary-value total-highlight">$${order.total.toFixed(2)}</span>
+                    <span class="summary-value total-highlight">$${order.total.amount}</span>
                 </div>
             </div>
             
@@ -308,36 +381,36 @@ function createOrderTicket(order) {
 
             <div class="order-total">
                 <span class="order-total-label">Total:</span>
-                <span class="order-total-amount">$${order.total.toFixed(2)}</span>
+                <span class="order-total-amount">$${order.total.amount}</span>
             </div>
 
-            ${deliveredButton ? `<div class="order-actions">${deliveredButton}</div>` : ''}
+            ${statusButtons ? `<div class="order-actions">${statusButtons}</div>` : ''}
         </div>
     `;
 }
 
-// Mark order as delivered
-async function markAsDelivered(orderMongoId, orderId) {
-    if (!confirm(`Are you sure you want to mark Order #${orderId} as delivered?`)) {
+// Move an order to a new status
+async function updateOrderStatus(orderMongoId, orderId, status) {
+    const action = STATUS_ACTIONS[status].replace('✓ ', '').toLowerCase();
+    if (!confirm(`Are you sure you want to ${action} Order #${orderId}?`)) {
         return;
     }
 
     try {
-        const response = await fetch(`/api/orders/${orderMongoId}/deliver`, getFetchOptions('POST', null, true));
+        const response = await fetch(`/api/orders/${orderMongoId}/status`, getFetchOptions('POST', { status }, true));
 
         if (!response.ok) {
             const error = await response.json();
-            throw new Error(error.error || 'Failed to mark order as delivered');
+            throw new Error(error.error || 'Failed to update order status');
         }
 
-        const result = await response.json();
-        showNotification(`Order #${orderId} has been marked as delivered!`);
+        showNotification(`Order #${orderId} is now ${status}`);
 
-        // Reload orders to remove the delivered order
+        // Reload orders to show the new status
         loadOrders();
     } catch (error) {
-        console.error('Error marking order as delivered:', error);
-        showError(error.message || 'Failed to mark order as delivered. Please try again.');
+        console.error('Error updating order status:', error);
+        showError(error.message || 'Failed to update order status. Please try again.');
     }
 }
 
@@ -426,8 +499,43 @@ function setupEventListeners() {
     });
 }
 
-// Auto-refresh every 30 seconds
-setInterval(() => {
-    loadOrders();
-}, 30000);
+// Subscribe to live order updates. The browser reconnects on its own and
+// the server replays anything missed since the last received event.
+function connectOrderEvents() {
+    if (orderEvents || !window.EventSource) {
+        return;
+    }
+
+    orderEvents = new EventSource('/api/orders/events', { withCredentials: true });
+
+    orderEvents.addEventListener('order.created', (e) => {
+        const { order } = JSON.parse(e.data);
+        orders = [order, ...orders.filter(o => o.id !== order.id)];
+        displayOrders(orders);
+    });
+
+    orderEvents.addEventListener('order.status_changed', (e) => {
+        const { order } = JSON.parse(e.data);
+        orders = orders.map(o => o.id === order.id ? order : o);
+        displayOrders(orders);
+    });
+
+    orderEvents.addEventListener('order.delivered', (e) => {
+        // Delivered orders leave the tickets view
+        const { order } = JSON.parse(e.data);
+        orders = orders.filter(o => o.id !== order.id);
+        displayOrders(orders);
+    });
+
+    // Missed events could not be replayed; reload everything
+    orderEvents.addEventListener('resync', () => loadOrders());
+}
+
+// Close the live updates stream
+function disconnectOrderEvents() {
+    if (orderEvents) {
+        orderEvents.close();
+        orderEvents = null;
+    }
+}
 
@@ -2,6 +2,8 @@
 let products = [];
 let cart = [];
 let filteredProducts = [];
+// Sent as Idempotency-Key so a double-tapped or retried checkout creates one order
+let checkoutIdempotencyKey = null;
 
 // Initialize app
 document.addEventListener('DOMContentLoaded', async () => {
@@ -11,6 +13,12 @@ document.addEventListener('DOMContentLoaded', async () => {
     updateCartDisplay();
 });
 
+// Format whole cents for display, e.g. 899 → "8.99". Prices arrive as
+// {amount, cents, currency}; add cents, never amounts.
+function formatCents(cents) {
+    return (cents / 100).toFixed(2);
+}
+
 // Helper function to create fetch options with ngrok header
 function getFetchOptions(method = 'GET', body = null, includeAuth = false) {
     const options = {
@@ -82,13 +90,24 @@ function displayProducts(productsToShow) {
             imageDisplay = `<div class="product-image">📦</div>`;
         }
     
+        // Products with variants (sizes, flavours) are priced per variant
+        const variants = product.variants || [];
+        const variantSelect = variants.length === 0 ? '' : `
+                <select class="variant-select" id="variant-${product.productId}">
+                    ${variants.map(v => `
+                        <option value="${v.sku}" ${v.available ? '' : 'disabled'}>
+                            ${v.name} - $${v.price.amount}${v.available ? '' : ' (sold out)'}
+                        </option>`).join('')}
+                </select>`;
+
         return `
             <div class="product-card">
                 ${imageDisplay}
                 <div class="product-name">${product.name}</div>
                 <div class="product-description">${product.description}</div>
+                ${variantSelect}
                 <div class="product-footer">
-                    <div class="product-price">$${product.price.toFixed(2)}</div>
+                    <div class="product-price">${variants.length ? 'From ' : ''}$${product.price.amount}</div>
                     <button class="add-to-cart-btn" onclick="addToCart(${product.productId})">
                         Add to Cart
                     </button>
@@ -110,44 +129,67 @@ function filterProducts(category) {
     displayProducts(filteredProducts);
 }
 
-// Add product to cart
+// Cart lines are per product and variant
+function cartKey(item) {
+    return `${item.productId}:${item.sku || ''}`;
+}
+
+// Add product to cart, in the variant picked on its card
 function addToCart(productId) {
     const product = products.find(p => p.productId === productId);
     if (!product) return;
 
-    const existingItem = cart.find(item => item.productId === productId);
+    let variant = null;
+    if (product.variants && product.variants.length > 0) {
+        const sku = document.getElementById(`variant-${productId}`).value;
+        variant = product.variants.find(v => v.sku === sku && v.available);
+        if (!variant) {
+            showError(`${product.name} is sold out`);
+            return;
+        }
+    }
+
+    const sku = variant ? variant.sku : '';
+    const existingItem = cart.find(item => cartKey(item) === `${productId}:${sku}`);
     
     if (existingItem) {
         existingItem.quantity++;
     } else {
         cart.push({
             productId: product.productId,
+            sku: sku,
             quantity: 1,
-            product: product
+            product: product,
+            variant: variant
         });
     }
 
     saveCartToStorage();
     updateCartDisplay();
-    showNotification(`${product.name} added to cart!`);
+    showNotification(`${product.name}${variant ? ' (' + variant.name + ')' : ''} added to cart!`);
+}
+
+// Price of one unit of a cart line
+function cartItemPrice(item) {
+    return item.variant ? item.variant.price : item.product.price;
 }
 
 // Remove item from cart
-function removeFromCart(productId) {
-    cart = cart.filter(item => item.productId !== productId);
+function removeFromCart(key) {
+    cart = cart.filter(item => cartKey(item) !== key);
     saveCartToStorage();
     updateCartDisplay();
 }
 
 // Update quantity
-function updateQuantity(productId, change) {
-    const item = cart.find(item => item.productId === productId);
+function updateQuantity(key, change) {
+    const item = cart.find(item => cartKey(item) === key);
     if (!item) return;
 
     item.quantity += change;
     
     if (item.quantity <= 0) {
-        removeFromCart(productId);
+        removeFromCart(key);
     } else {
         saveCartToStorage();
         updateCartDisplay();
@@ -179,22 +221,23 @@ function updateCartDisplay() {
     cartItems.innerHTML = validCart.map(item => `
         <div class="cart-item">
             <div class="cart-item-info">
-                <div class="cart-item-name">${item.product.name}</div>
-                <div class="cart-item-price">$${item.product.price.toFixed(2)} each</div>
+                <div class="cart-item-name">${item.product.name}${item.variant ? ' (' + item.variant.name + ')' : ''}</div>
+                <div class="cart-item-price">$${cartItemPrice(item).amount} each</div>
             </div>
             <div class="cart-item-controls">
                 <div class="quantity-control">
-                    <button class="quantity-btn" onclick="updateQuantity(${item.productId}, -1)">-</button>
+                    <button class="quantity-btn" onclick="updateQuantity('${cartKey(item)}', -1)">-</button>
                     <span class="quantity">${item.quantity}</span>
-                    <button class="quantity-btn" onclick="updateQuantity(${item.productId}, 1)">+</button>
+                    <button class="quantity-btn" onclick="updateQuantity('${cartKey(item)}', 1)">+</button>
                 </div>
-                <button class="remove-btn" onclick="removeFromCart(${item.productId})">Remove</button>
+                <button class="remove-btn" onclick="removeFromCart('${cartKey(item)}')">Remove</button>
             </div>
         </div>
     `).join('');
 
-    const total = validCart.reduce((sum, item) => sum + (item.product.price * item.quantity), 0);
-    document.getElementById('total-amount').textContent = total.toFixed(2);
+    // Add up whole cents so the total is exact
+    const totalCents = validCart.reduce((sum, item) => sum + (cartItemPrice(item).cents * item.quantity), 0);
+    document.getElementById('total-amount').textContent = formatCents(totalCents);
     cartTotal.style.display = 'block';
     
     // Update cart to remove invalid items if any were filtered out
@@ -266,6 +309,17 @@ function setupEventListeners() {
     checkAdminAccess();
 }
 
+// Read a cookie set by the server
+function getCookie(name) {
+    for (const cookie of document.cookie.split(';')) {
+        const [key, value] = cookie.trim().split('=');
+        if (key === name) {
+            return value;
+        }
+    }
+    return null;
+}
+
 // Check if user has admin access
 function checkAdminAccess() {
     const token = localStorage.getItem('auth_token');
@@ -332,6 +386,22 @@ async function handleAddProduct(e) {
     formData.append("price", document.getElementById('product-price').value);
     formData.append("category", document.getElementById('product-category').value);
 
+    // Variants are typed one per line as "name | price | SKU"
+    const variantLines = document.getElementById('product-variants').value
+        .split('\n').map(line => line.trim()).filter(line => line !== '');
+    const variants = variantLines.map(line => {
+        const [name, price, sku] = line.split('|').map(part => (part || '').trim());
+        return { name, price, sku };
+    });
+    if (variants.some(v => !v.name || !v.price || !v.sku)) {
+        errorDiv.textContent = 'Write each variant as: name | price | SKU';
+        errorDiv.style.display = 'block';
+        return;
+    }
+    if (variants.length > 0) {
+        formData.append("variants", JSON.stringify(variants));
+    }
+
     const imageInput = document.getElementById('product-image');
 
     // Add image if selected
@@ -344,6 +414,8 @@ async function handleAddProduct(e) {
     try {
         const response = await fetch('/api/products', {
             method: "POST",
+            // The login cookie authenticates this request, so it needs the CSRF token
+            headers: { 'X-CSRF-Token': getCookie('csrf_token') || '' },
             body: formData  // browser sets multipart/form-data automatically
         });
 
@@ -407,19 +479,41 @@ async function handleCheckout(e) {
             name: document.getElementById('name').value,
             email: document.getElementById('email').value,
             phone: document.getElementById('phone').value,
-            address: document.getElementById('address').value
+            address: document.getElementById('address').value,
+            // Delivery tax depends on the region
+            region: document.getElementById('region').value
         },
         items: cart.map(item => ({
             productId: item.productId,
+            sku: item.sku || '',
             quantity: item.quantity
-        }))
+        })),
+        couponCode: document.getElementById('coupon-code').value.trim()
     };
 
+    // Reuse the key until the order goes through
+    if (!checkoutIdempotencyKey) {
+        checkoutIdempotencyKey = generateIdempotencyKey();
+    }
+    const options = getFetchOptions('POST', formData, false);
+    options.headers['Idempotency-Key'] = checkoutIdempotencyKey;
+    // Logged-in customers get the order added to their account
+    const customerCSRF = getCookie('customer_csrf_token');
+    if (customerCSRF) {
+        options.headers['X-CSRF-Token'] = customerCSRF;
+    }
+
     try {
-        const response = await fetch('/api/orders', getFetchOptions('POST', formData, false));
+        const response = await fetch('/api/orders', options);
 
         if (!response.ok) {
-            throw new Error('Failed to place order');
+            const data = await response.json().catch(() => ({}));
+            // List each rejected line by product name
+            const lines = (data.items || []).map(line => {
+                const product = products.find(p => p.productId === line.productId);
+                return `${product ? product.name : 'Product #' + line.productId}: ${line.error}`;
+            });
+            throw new Error([data.error || 'Failed to place order', ...lines].join('\n'));
         }
 
         const order = await response.json();
@@ -438,12 +532,22 @@ async function handleCheckout(e) {
 
     } catch (error) {
         console.error('Error placing order:', error);
-        showError('Failed to place order. Please try again.');
+        showError(error.message || 'Failed to place order. Please try again.');
+    }
+}
+
+// Generate a random key for the Idempotency-Key header
+function generateIdempotencyKey() {
+    if (window.crypto && crypto.randomUUID) {
+        return crypto.randomUUID();
     }
+    return Date.now().toString(36) + '-' + Math.random().toString(36).slice(2);
 }
 
 // Save cart to localStorage
 function saveCartToStorage() {
+    // A different cart is a different order
+    checkoutIdempotencyKey = null;
     localStorage.setItem('subuBakeryCart', JSON.stringify(cart));
 }
 
@@ -501,6 +605,7 @@ function showError(message) {
         box-shadow: 0 4px 10px rgba(0,0,0,0.2);
         z-index: 1000;
         animation: slideIn 0.3s ease;
+        white-space: pre-line;
     `;
     error.textContent = message;
     document.body.appendChild(error);
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the requested document does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrStatusConflict is returned when an order is no longer in the status a change expects
+	ErrStatusConflict = errors.New("order status conflict")
+
+	// ErrDuplicateID is returned when inserting a product or order whose ID
+	// or number is already taken
+	ErrDuplicateID = errors.New("duplicate product or order number")
+)
+
+// Counter names for NextSequence
+const (
+	orderIDSequence   = "orderId"
+	productIDSequence = "productId"
+)
+
+// ProductUpdate holds the editable fields of a product.
+// Image is left untouched when empty; Variants replace the product's.
+type ProductUpdate struct {
+	Name        string
+	Description string
+	Price       Money
+	Variants    []ProductVariant
+	Category    string
+	Image       string
+}
+
+// Store is the persistence layer used by the HTTP handlers
+type Store interface {
+	// Products. InsertProducts and UpdateProduct return ErrSKUExists when
+	// another product has one of the variants' SKUs.
+	ListProducts(ctx context.Context) ([]Product, error)
+	GetProduct(ctx context.Context, id primitive.ObjectID) (Product, error)
+	GetProductByProductID(ctx context.Context, productID int) (Product, error)
+	InsertProducts(ctx context.Context, products ...Product) error
+	UpdateProduct(ctx context.Context, id primitive.ObjectID, update ProductUpdate) error
+	DeleteProduct(ctx context.Context, id primitive.ObjectID) error
+
+	// Orders
+	ListOrders(ctx context.Context) ([]Order, error)
+	ListDeliveredOrders(ctx context.Context) ([]Order, error)
+	// GetOrder looks up an order among both the active and the delivered orders
+	GetOrder(ctx context.Context, id primitive.ObjectID) (Order, error)
+	InsertOrder(ctx context.Context, order Order) error
+	// PlaceOrder saves a new order in one transaction: it counts a use of
+	// every promotion in promotions, numbers the order from the orderId
+	// counter and inserts it. A promotion that ran out or was deleted fails
+	// it with a promotionError, and nothing is saved.
+	PlaceOrder(ctx context.Context, order Order, promotions []primitive.ObjectID) (Order, error)
+
+	// UpdateOrderStatus applies change to an order that is still in status
+	// change.From, or returns ErrStatusConflict. Orders reaching
+	// StatusDelivered are moved into the delivered orders.
+	UpdateOrderStatus(ctx context.Context, id primitive.ObjectID, change StatusChange) (Order, error)
+
+	// NextSequence atomically increments the named counter and returns the
+	// new value, so concurrent callers never receive the same number
+	NextSequence(ctx context.Context, name string) (int, error)
+
+	// Idempotency keys. ReserveIdempotencyKey stores the record unless the key
+	// exists, in which case it returns the existing record and
+	// ErrIdempotencyKeyExists. Complete and Release only touch the key while
+	// record.Owner still holds it.
+	ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	ReleaseIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+
+	// Staff users, looked up by their normalized username. InsertUser
+	// returns ErrUserExists when the username is taken.
+	ListUsers(ctx context.Context) ([]StaffUser, error)
+	GetUser(ctx context.Context, username string) (StaffUser, error)
+	InsertUser(ctx context.Context, user StaffUser) error
+	UpdateUser(ctx context.Context, username string, update StaffUserUpdate) (StaffUser, error)
+	DeleteUser(ctx context.Context, username string) error
+	// UpdateUserTwoFactor replaces the user's 2FA settings if they are still
+	// at version, bumping the version, or returns ErrTwoFactorConflict
+	UpdateUserTwoFactor(ctx context.Context, username string, version int, twoFactor TwoFactor) error
+
+	// Staff login sessions
+	SessionStore
+	// CustomerSessions stores customer logins, apart from staff sessions
+	CustomerSessions() SessionStore
+
+	// Failed login counters. RecordLoginFailure atomically adds a failure
+	// to the key, starting over when the previous one is older than window.
+	// DeleteStaleLoginThrottles removes counters last failed before before.
+	RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (LoginThrottle, error)
+	GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error)
+	DeleteLoginThrottle(ctx context.Context, key string) error
+	DeleteStaleLoginThrottles(ctx context.Context, before time.Time) error
+
+	// API keys, looked up by the hash of the key
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	InsertAPIKey(ctx context.Context, key APIKey) error
+	DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error
+
+	// Customer accounts, looked up by email. ListCustomerOrders returns the
+	// active and delivered orders of a customer, newest first.
+	InsertCustomer(ctx context.Context, customer CustomerAccount) error
+	GetCustomerByEmail(ctx context.Context, email string) (CustomerAccount, error)
+	UpdateCustomer(ctx context.Context, id primitive.ObjectID, update CustomerUpdate) (CustomerAccount, error)
+	ListCustomerOrders(ctx context.Context, customerID string) ([]Order, error)
+
+	// Magic links. ConsumeMagicLink removes the link with the given ID and
+	// returns it, so each link can be used once. Expired links are removed
+	// by the store in its own time.
+	InsertMagicLink(ctx context.Context, link MagicLink) error
+	ConsumeMagicLink(ctx context.Context, id string) (MagicLink, error)
+
+	// Promotions and coupons. InsertPromotion and UpdatePromotion return
+	// ErrPromotionExists for a coupon code already in use; UpdatePromotion
+	// leaves Uses alone. AddPromotionUses adds n (which may be negative) to
+	// Uses, or returns ErrPromotionUsedUp if that would go over MaxUses.
+	ListPromotions(ctx context.Context) ([]Promotion, error)
+	GetPromotion(ctx context.Context, id primitive.ObjectID) (Promotion, error)
+	InsertPromotion(ctx context.Context, promotion Promotion) error
+	UpdatePromotion(ctx context.Context, promotion Promotion) error
+	DeletePromotion(ctx context.Context, id primitive.ObjectID) error
+	AddPromotionUses(ctx context.Context, id primitive.ObjectID, n int) error
+
+	// Audit log, append-only. ListAuditEntries returns one page of the
+	// matching entries, newest first, and how many match in total.
+	InsertAuditEntry(ctx context.Context, entry AuditEntry) error
+	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error)
+
+	Close(ctx context.Context) error
+}
+
+// openStore creates the Store selected by the STORAGE_BACKEND environment variable
+func openStore(ctx context.Context) (Store, error) {
+	switch backend := getEnv("STORAGE_BACKEND", "mongo"); backend {
+	case "mongo":
+		mongoURI := "mongodb://localhost:27017"
+		if uri := getEnv("MONGODB_URI", ""); uri != "" {
+			mongoURI = uri
+		}
+		return newMongoStore(ctx, mongoURI)
+	case "sqlite":
+		return newSQLiteStore(ctx, getEnv("SQLITE_PATH", "sububakery.db"))
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
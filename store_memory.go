@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore is an in-memory implementation of Store.
+// Nothing survives a restart; it is meant for local development and tests.
+type memoryStore struct {
+	mu        sync.RWMutex
+	products  []Product
+	orders    []Order
+	delivered []Order
+	sequences map[string]int
+	idemKeys  map[string]IdempotencyRecord
+	users     []StaffUser
+	throttles map[string]LoginThrottle
+	apiKeys   []APIKey
+	customers []CustomerAccount
+	links     map[string]MagicLink
+	promos    []Promotion
+	audit     []AuditEntry
+
+	// Staff sessions, and customer sessions kept apart from them
+	*memorySessions
+	customerSessions *memorySessions
+}
+
+// newMemoryStore returns an empty in-memory Store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		sequences:        make(map[string]int),
+		idemKeys:         make(map[string]IdempotencyRecord),
+		memorySessions:   newMemorySessions(),
+		customerSessions: newMemorySessions(),
+		throttles:        make(map[string]LoginThrottle),
+		links:            make(map[string]MagicLink),
+	}
+}
+
+func (s *memoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) ListProducts(ctx context.Context) ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	productsList := make([]Product, len(s.products))
+	copy(productsList, s.products)
+	return productsList, nil
+}
+
+func (s *memoryStore) GetProduct(ctx context.Context, id primitive.ObjectID) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.products {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Product{}, ErrNotFound
+}
+
+func (s *memoryStore) GetProductByProductID(ctx context.Context, productID int) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.products {
+		if p.ProductID == productID {
+			return p, nil
+		}
+	}
+	return Product{}, ErrNotFound
+}
+
+func (s *memoryStore) InsertProducts(ctx context.Context, products ...Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Unique like the indexes of the other backends, and all or nothing
+	ids := make(map[primitive.ObjectID]bool)
+	numbers := make(map[int]bool)
+	skus := s.skuOwners(primitive.NilObjectID)
+	for _, p := range s.products {
+		ids[p.ID], numbers[p.ProductID] = true, true
+	}
+	for _, p := range products {
+		if ids[p.ID] || numbers[p.ProductID] {
+			return ErrDuplicateID
+		}
+		ids[p.ID], numbers[p.ProductID] = true, true
+		for _, v := range p.Variants {
+			if owner, ok := skus[v.SKU]; ok && owner != p.ID {
+				return fmt.Errorf("%w: %s", ErrSKUExists, v.SKU)
+			}
+			skus[v.SKU] = p.ID
+		}
+	}
+	s.products = append(s.products, products...)
+
+	// Keep the counter ahead of numbers assigned by the caller, such as the
+	// default products
+	if _, ok := s.sequences[productIDSequence]; ok {
+		for _, p := range products {
+			if p.ProductID > s.sequences[productIDSequence] {
+				s.sequences[productIDSequence] = p.ProductID
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateProduct(ctx context.Context, id primitive.ObjectID, update ProductUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.products {
+		if s.products[i].ID != id {
+			continue
+		}
+		skus := s.skuOwners(id)
+		for _, v := range update.Variants {
+			if _, ok := skus[v.SKU]; ok {
+				return fmt.Errorf("%w: %s", ErrSKUExists, v.SKU)
+			}
+		}
+
+		p := &s.products[i]
+		p.Name = update.Name
+		p.Description = update.Description
+		p.Price = update.Price
+		p.Variants = update.Variants
+		p.Category = update.Category
+		if update.Image != "" {
+			p.Image = update.Image
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+// skuOwners maps the variant SKUs of every product other than except to the
+// product; the caller holds the lock
+func (s *memoryStore) skuOwners(except primitive.ObjectID) map[string]primitive.ObjectID {
+	owners := make(map[string]primitive.ObjectID)
+	for _, p := range s.products {
+		if p.ID == except {
+			continue
+		}
+		for _, v := range p.Variants {
+			owners[v.SKU] = p.ID
+		}
+	}
+	return owners
+}
+
+func (s *memoryStore) DeleteProduct(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.products {
+		if p.ID == id {
+			s.products = append(s.products[:i], s.products[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) ListOrders(ctx context.Context) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]Order, len(s.orders))
+	copy(orders, s.orders)
+
+	// Newest first
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	return orders, nil
+}
+
+func (s *memoryStore) ListDeliveredOrders(ctx context.Context) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]Order, len(s.delivered))
+	copy(orders, s.delivered)
+
+	// Most recently delivered first
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].DeliveredAt.After(*orders[j].DeliveredAt)
+	})
+	return orders, nil
+}
+
+func (s *memoryStore) GetOrder(ctx context.Context, id primitive.ObjectID) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, o := range s.orders {
+		if o.ID == id {
+			return o, nil
+		}
+	}
+	for _, o := range s.delivered {
+		if o.ID == id {
+			return o, nil
+		}
+	}
+	return Order{}, ErrNotFound
+}
+
+func (s *memoryStore) InsertOrder(ctx context.Context, order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertOrder(order)
+}
+
+// insertOrder adds order unless its ID or number is taken; the caller
+// holds the lock
+func (s *memoryStore) insertOrder(order Order) error {
+	// Numbers stay unique once the order has been delivered
+	for _, orders := range [][]Order{s.orders, s.delivered} {
+		for _, other := range orders {
+			if other.ID == order.ID || other.OrderID == order.OrderID {
+				return ErrDuplicateID
+			}
+		}
+	}
+	s.orders = append(s.orders, order)
+	return nil
+}
+
+func (s *memoryStore) PlaceOrder(ctx context.Context, order Order, promotions []primitive.ObjectID) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check every promotion before changing anything
+	var redeemed []*Promotion
+	for _, id := range promotions {
+		var promotion *Promotion
+		for i := range s.promos {
+			if s.promos[i].ID == id {
+				promotion = &s.promos[i]
+			}
+		}
+		if promotion == nil {
+			return Order{}, promotionError{id, ErrNotFound}
+		}
+		if promotion.MaxUses > 0 && promotion.Uses+1 > promotion.MaxUses {
+			return Order{}, promotionError{id, ErrPromotionUsedUp}
+		}
+		redeemed = append(redeemed, promotion)
+	}
+
+	order.OrderID = s.nextSequence(orderIDSequence)
+	if err := s.insertOrder(order); err != nil {
+		return Order{}, err
+	}
+	for _, p := range redeemed {
+		p.Uses++
+	}
+	return order, nil
+}
+
+func (s *memoryStore) UpdateOrderStatus(ctx context.Context, id primitive.ObjectID, change StatusChange) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.orders {
+		if s.orders[i].ID != id {
+			continue
+		}
+		if s.orders[i].Status != change.From {
+			return Order{}, ErrStatusConflict
+		}
+		o := s.orders[i]
+		o.StatusHistory = append([]StatusChange(nil), o.StatusHistory...)
+		applyStatusChange(&o, change)
+		if change.To == StatusDelivered {
+			s.orders = append(s.orders[:i], s.orders[i+1:]...)
+			s.delivered = append(s.delivered, o)
+		} else {
+			s.orders[i] = o
+		}
+		return o, nil
+	}
+
+	for i := range s.delivered {
+		if s.delivered[i].ID != id {
+			continue
+		}
+		if s.delivered[i].Status != change.From {
+			return Order{}, ErrStatusConflict
+		}
+		o := s.delivered[i]
+		o.StatusHistory = append([]StatusChange(nil), o.StatusHistory...)
+		applyStatusChange(&o, change)
+		s.delivered[i] = o
+		return o, nil
+	}
+	return Order{}, ErrNotFound
+}
+
+// NextSequence increments the named counter. A counter starts from the
+// highest number already in use, including delivered orders.
+func (s *memoryStore) NextSequence(ctx context.Context, name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextSequence(name), nil
+}
+
+// nextSequence is NextSequence for a caller holding the lock
+func (s *memoryStore) nextSequence(name string) int {
+	if _, ok := s.sequences[name]; !ok {
+		s.sequences[name] = s.highestInUse(name)
+	}
+	s.sequences[name]++
+	return s.sequences[name]
+}
+
+// highestInUse returns the highest number of the named counter found in the data
+func (s *memoryStore) highestInUse(name string) int {
+	var highest int
+	switch name {
+	case orderIDSequence:
+		for _, orders := range [][]Order{s.orders, s.delivered} {
+			for _, o := range orders {
+				if o.OrderID > highest {
+					highest = o.OrderID
+				}
+			}
+		}
+	case productIDSequence:
+		for _, p := range s.products {
+			if p.ProductID > highest {
+				highest = p.ProductID
+			}
+		}
+	}
+	return highest
+}
+
+func (s *memoryStore) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Sweep expired keys
+	now := time.Now()
+	for key, r := range s.idemKeys {
+		if now.After(r.ExpiresAt) {
+			delete(s.idemKeys, key)
+		}
+	}
+
+	if existing, ok := s.idemKeys[record.Key]; ok {
+		return existing, ErrIdempotencyKeyExists
+	}
+	s.idemKeys[record.Key] = record
+	return record, nil
+}
+
+func (s *memoryStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idemKeys[record.Key]; ok && existing.Owner == record.Owner {
+		s.idemKeys[record.Key] = record
+	}
+	return nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idemKeys[record.Key]; ok && existing.Owner == record.Owner {
+		delete(s.idemKeys, record.Key)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context) ([]StaffUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]StaffUser, len(s.users))
+	copy(users, s.users)
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, username string) (StaffUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return StaffUser{}, ErrNotFound
+}
+
+func (s *memoryStore) InsertUser(ctx context.Context, user StaffUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == user.Username {
+			return ErrUserExists
+		}
+	}
+	s.users = append(s.users, user)
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(ctx context.Context, username string, update StaffUserUpdate) (StaffUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.users {
+		if s.users[i].Username == username {
+			if update.Name != "" {
+				s.users[i].Name = update.Name
+			}
+			if update.Role != "" {
+				s.users[i].Role = update.Role
+			}
+			if update.PasswordHash != "" {
+				s.users[i].PasswordHash = update.PasswordHash
+			}
+			return s.users[i], nil
+		}
+	}
+	return StaffUser{}, ErrNotFound
+}
+
+func (s *memoryStore) UpdateUserTwoFactor(ctx context.Context, username string, version int, twoFactor TwoFactor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.users {
+		if s.users[i].Username == username {
+			if s.users[i].TwoFactor.Version != version {
+				return ErrTwoFactorConflict
+			}
+			twoFactor.Version = version + 1
+			s.users[i].TwoFactor = twoFactor
+			return nil
+		}
+	}
+	return ErrTwoFactorConflict
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, u := range s.users {
+		if u.Username == username {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// memorySessions is an in-memory SessionStore
+type memorySessions struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: make(map[string]Session)}
+}
+
+func (s *memoryStore) CustomerSessions() SessionStore {
+	return s.customerSessions
+}
+
+func (s *memorySessions) InsertSession(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessions) GetSession(ctx context.Context, id string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *memorySessions) TouchSession(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	session.LastSeenAt = lastSeenAt
+	session.ExpiresAt = expiresAt
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *memorySessions) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userSessions := []Session{}
+	for _, session := range s.sessions {
+		if session.Username == username {
+			userSessions = append(userSessions, session)
+		}
+	}
+	sort.Slice(userSessions, func(i, j int) bool {
+		return userSessions[i].LastSeenAt.After(userSessions[j].LastSeenAt)
+	})
+	return userSessions, nil
+}
+
+func (s *memorySessions) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessions) DeleteUserSessions(ctx context.Context, username, exceptID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for id, session := range s.sessions {
+		if session.Username == username && id != exceptID {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memorySessions) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok || throttle.LastFailureAt.Before(now.Add(-window)) {
+		throttle = LoginThrottle{Key: key}
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	s.throttles[key] = throttle
+	return throttle, nil
+}
+
+func (s *memoryStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok {
+		return LoginThrottle{}, ErrNotFound
+	}
+	return throttle, nil
+}
+
+func (s *memoryStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.throttles[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.throttles, key)
+	return nil
+}
+
+func (s *memoryStore) DeleteStaleLoginThrottles(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, throttle := range s.throttles {
+		if throttle.LastFailureAt.Before(before) {
+			delete(s.throttles, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		keys = append(keys, s.apiKeys[i])
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *memoryStore) InsertAPIKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKeys = append(s.apiKeys, key)
+	return nil
+}
+
+func (s *memoryStore) DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.apiKeys {
+		if key.ID == id {
+			s.apiKeys = append(s.apiKeys[:i], s.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) InsertCustomer(ctx context.Context, customer CustomerAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.customers {
+		if existing.Email == customer.Email {
+			return ErrCustomerExists
+		}
+	}
+	s.customers = append(s.customers, customer)
+	return nil
+}
+
+func (s *memoryStore) GetCustomerByEmail(ctx context.Context, email string) (CustomerAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, customer := range s.customers {
+		if customer.Email == email {
+			return customer, nil
+		}
+	}
+	return CustomerAccount{}, ErrNotFound
+}
+
+func (s *memoryStore) UpdateCustomer(ctx context.Context, id primitive.ObjectID, update CustomerUpdate) (CustomerAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.customers {
+		if s.customers[i].ID == id {
+			if update.Name != "" {
+				s.customers[i].Name = update.Name
+			}
+			if update.Phone != "" {
+				s.customers[i].Phone = update.Phone
+			}
+			if update.Addresses != nil {
+				s.customers[i].Addresses = update.Addresses
+			}
+			return s.customers[i], nil
+		}
+	}
+	return CustomerAccount{}, ErrNotFound
+}
+
+func (s *memoryStore) ListCustomerOrders(ctx context.Context, customerID string) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []Order{}
+	for _, list := range [][]Order{s.orders, s.delivered} {
+		for _, o := range list {
+			if o.CustomerID == customerID {
+				orders = append(orders, o)
+			}
+		}
+	}
+
+	// Newest first
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	return orders, nil
+}
+
+func (s *memoryStore) InsertMagicLink(ctx context.Context, link MagicLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, existing := range s.links {
+		if existing.ExpiresAt.Before(link.CreatedAt) {
+			delete(s.links, id)
+		}
+	}
+	s.links[link.ID] = link
+	return nil
+}
+
+func (s *memoryStore) ConsumeMagicLink(ctx context.Context, id string) (MagicLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[id]
+	if !ok {
+		return MagicLink{}, ErrNotFound
+	}
+	delete(s.links, id)
+	return link, nil
+}
+
+func (s *memoryStore) ListPromotions(ctx context.Context) ([]Promotion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	promotions := make([]Promotion, len(s.promos))
+	copy(promotions, s.promos)
+	return promotions, nil
+}
+
+func (s *memoryStore) GetPromotion(ctx context.Context, id primitive.ObjectID) (Promotion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.promos {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Promotion{}, ErrNotFound
+}
+
+// codeTaken reports whether another promotion than id has code; the caller
+// holds the lock
+func (s *memoryStore) codeTaken(code string, id primitive.ObjectID) bool {
+	for _, p := range s.promos {
+		if code != "" && p.Code == code && p.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) InsertPromotion(ctx context.Context, promotion Promotion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.codeTaken(promotion.Code, promotion.ID) {
+		return ErrPromotionExists
+	}
+	s.promos = append(s.promos, promotion)
+	return nil
+}
+
+func (s *memoryStore) UpdatePromotion(ctx context.Context, promotion Promotion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.codeTaken(promotion.Code, promotion.ID) {
+		return ErrPromotionExists
+	}
+	for i := range s.promos {
+		if s.promos[i].ID == promotion.ID {
+			promotion.Uses = s.promos[i].Uses
+			s.promos[i] = promotion
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) DeletePromotion(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.promos {
+		if p.ID == id {
+			s.promos = append(s.promos[:i], s.promos[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) AddPromotionUses(ctx context.Context, id primitive.ObjectID, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.promos {
+		p := &s.promos[i]
+		if p.ID != id {
+			continue
+		}
+		if n > 0 && p.MaxUses > 0 && p.Uses+n > p.MaxUses {
+			return ErrPromotionUsedUp
+		}
+		p.Uses += n
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func (s *memoryStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []AuditEntry{}
+	total := 0
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if !filter.matches(s.audit[i]) {
+			continue
+		}
+		if total >= filter.Offset && len(entries) < filter.Limit {
+			entries = append(entries, s.audit[i])
+		}
+		total++
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryStoreRejectsDuplicateProducts(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	cookies := Product{ID: primitive.NewObjectID(), ProductID: 1, Name: "Cookies"}
+	if err := s.InsertProducts(ctx, cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		products []Product
+	}{
+		{"same number", []Product{{ID: primitive.NewObjectID(), ProductID: 1}}},
+		{"same ID", []Product{{ID: cookies.ID, ProductID: 2}}},
+		{"duplicates in the batch", []Product{{ID: primitive.NewObjectID(), ProductID: 3}, {ID: primitive.NewObjectID(), ProductID: 3}}},
+		{"one bad product in the batch", []Product{{ID: primitive.NewObjectID(), ProductID: 4}, {ID: primitive.NewObjectID(), ProductID: 1}}},
+	}
+	for _, tt := range tests {
+		if err := s.InsertProducts(ctx, tt.products...); !errors.Is(err, ErrDuplicateID) {
+			t.Errorf("%s: err = %v, want ErrDuplicateID", tt.name, err)
+		}
+	}
+
+	// Rejected batches are not inserted at all
+	products, err := s.ListProducts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 {
+		t.Errorf("%d products stored, want 1", len(products))
+	}
+}
+
+func TestMemoryStoreRejectsDuplicateOrders(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	first := Order{ID: primitive.NewObjectID(), OrderID: 1}
+	if err := s.InsertOrder(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.InsertOrder(ctx, Order{ID: primitive.NewObjectID(), OrderID: 1}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("same number: err = %v, want ErrDuplicateID", err)
+	}
+	if err := s.InsertOrder(ctx, Order{ID: first.ID, OrderID: 2}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("same ID: err = %v, want ErrDuplicateID", err)
+	}
+	if err := s.InsertOrder(ctx, Order{ID: primitive.NewObjectID(), OrderID: 2}); err != nil {
+		t.Errorf("new order: %v", err)
+	}
+
+	// Delivered orders keep their numbers
+	delivered := StatusChange{From: first.Status, To: StatusDelivered, ChangedAt: time.Now()}
+	if _, err := s.UpdateOrderStatus(ctx, first.ID, delivered); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertOrder(ctx, Order{ID: primitive.NewObjectID(), OrderID: 1}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("number of a delivered order: err = %v, want ErrDuplicateID", err)
+	}
+	if err := s.InsertOrder(ctx, Order{ID: first.ID, OrderID: 3}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("ID of a delivered order: err = %v, want ErrDuplicateID", err)
+	}
+}
+
+func TestMemoryStoreProductCounterSkipsInsertedNumbers(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	if _, err := s.NextSequence(ctx, productIDSequence); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertProducts(ctx, Product{ID: primitive.NewObjectID(), ProductID: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := s.NextSequence(ctx, productIDSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 9 {
+		t.Errorf("next product number = %d, want 9", next)
+	}
+}
+
+func TestMemoryStorePlaceOrder(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	open := Promotion{ID: primitive.NewObjectID(), Name: "Open"}
+	last := Promotion{ID: primitive.NewObjectID(), Name: "Last one", MaxUses: 1}
+	for _, p := range []Promotion{open, last} {
+		if err := s.InsertPromotion(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order, err := s.PlaceOrder(ctx, Order{ID: primitive.NewObjectID()}, []primitive.ObjectID{open.ID, last.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderID != 1 {
+		t.Errorf("orderId = %d, want 1", order.OrderID)
+	}
+
+	// The limited promotion has run out, so nothing of the second order is kept
+	_, err = s.PlaceOrder(ctx, Order{ID: primitive.NewObjectID()}, []primitive.ObjectID{open.ID, last.ID})
+	var promoErr promotionError
+	if !errors.As(err, &promoErr) || promoErr.id != last.ID || !errors.Is(err, ErrPromotionUsedUp) {
+		t.Fatalf("err = %v, want the last promotion used up", err)
+	}
+	if p, _ := s.GetPromotion(ctx, open.ID); p.Uses != 1 {
+		t.Errorf("open promotion used %d times, want 1", p.Uses)
+	}
+	if orders, _ := s.ListOrders(ctx); len(orders) != 1 {
+		t.Errorf("%d orders saved, want 1", len(orders))
+	}
+
+	// Nor did it take an order number
+	order, err = s.PlaceOrder(ctx, Order{ID: primitive.NewObjectID()}, []primitive.ObjectID{open.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderID != 2 {
+		t.Errorf("orderId = %d, want 2", order.OrderID)
+	}
+}
+
+func TestMemoryStoreRejectsDuplicateSKUs(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	cake := Product{ID: primitive.NewObjectID(), ProductID: 1, Variants: []ProductVariant{{SKU: "CAKE-6"}, {SKU: "CAKE-8"}}}
+	if err := s.InsertProducts(ctx, cake); err != nil {
+		t.Fatal(err)
+	}
+
+	pie := Product{ID: primitive.NewObjectID(), ProductID: 2, Variants: []ProductVariant{{SKU: "CAKE-8"}}}
+	if err := s.InsertProducts(ctx, pie); !errors.Is(err, ErrSKUExists) {
+		t.Errorf("insert: err = %v, want ErrSKUExists", err)
+	}
+
+	pie.Variants = []ProductVariant{{SKU: "PIE-9"}}
+	if err := s.InsertProducts(ctx, pie); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateProduct(ctx, pie.ID, ProductUpdate{Variants: []ProductVariant{{SKU: "CAKE-6"}}}); !errors.Is(err, ErrSKUExists) {
+		t.Errorf("update: err = %v, want ErrSKUExists", err)
+	}
+
+	// A product keeps its own SKUs when updated
+	if err := s.UpdateProduct(ctx, cake.ID, ProductUpdate{Variants: []ProductVariant{{SKU: "CAKE-8"}}}); err != nil {
+		t.Errorf("update own SKUs: %v", err)
+	}
+}
@@ -0,0 +1,1143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the MongoDB implementation of Store
+type mongoStore struct {
+	client    *mongo.Client
+	db        *mongo.Database
+	products  *mongo.Collection
+	orders    *mongo.Collection
+	delivered *mongo.Collection
+	counters  *mongo.Collection
+	orderNums *mongo.Collection
+	idemKeys  *mongo.Collection
+	users     *mongo.Collection
+	sessions  *mongo.Collection
+	throttles *mongo.Collection
+	apiKeys   *mongo.Collection
+	customers *mongo.Collection
+	links     *mongo.Collection
+	promos    *mongo.Collection
+	audit     *mongo.Collection
+
+	// transactions is false on standalone servers, see withTransaction
+	transactions bool
+
+	// Staff sessions, and customer sessions kept apart from them
+	*mongoSessions
+	customerSessions *mongoSessions
+}
+
+// newMongoStore connects to MongoDB and returns a Store backed by the sububakery database
+func newMongoStore(ctx context.Context, uri string) (*mongoStore, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	// Test connection
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	db := client.Database("sububakery")
+	s := &mongoStore{
+		client:    client,
+		db:        db,
+		products:  db.Collection("products"),
+		orders:    db.Collection("orders"),
+		delivered: db.Collection("delivered"),
+		counters:  db.Collection("counters"),
+		orderNums: db.Collection("order_numbers"),
+		idemKeys:  db.Collection("idempotency_keys"),
+		users:     db.Collection("users"),
+		sessions:  db.Collection("sessions"),
+		throttles: db.Collection("login_throttles"),
+		apiKeys:   db.Collection("api_keys"),
+		customers: db.Collection("customers"),
+		links:     db.Collection("magic_links"),
+		promos:    db.Collection("promotions"),
+		audit:     db.Collection("audit_log"),
+
+		transactions: detectTransactions(ctx, client),
+	}
+	s.mongoSessions = &mongoSessions{coll: s.sessions}
+	s.customerSessions = &mongoSessions{coll: db.Collection("customer_sessions")}
+
+	if !s.transactions {
+		log.Println("MongoDB is not a replica set; multi-document changes run without transactions")
+		if err := s.repairInterruptedMoves(ctx); err != nil {
+			client.Disconnect(ctx)
+			return nil, err
+		}
+	}
+
+	if err := s.migrateMoney(ctx); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	if err := s.seedCounters(ctx); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	if err := s.seedOrderNumbers(ctx); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	s.ensureIndexes(ctx)
+
+	return s, nil
+}
+
+// ensureIndexes creates the unique indexes on order and product numbers
+// and usernames.
+// Existing duplicates (from before the counters existed) prevent an index
+// from being built; that is logged rather than refusing to start.
+func (s *mongoStore) ensureIndexes(ctx context.Context) {
+	unique := []struct {
+		coll *mongo.Collection
+		key  string
+	}{
+		{s.orders, "orderId"},
+		{s.delivered, "orderId"},
+		{s.products, "productId"},
+		{s.users, "username"},
+		{s.apiKeys, "hash"},
+		{s.customers, "email"},
+	}
+	for _, idx := range unique {
+		_, err := idx.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{primitive.E{Key: idx.key, Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			log.Printf("Could not create unique index on %s.%s (duplicate numbers?): %v", idx.coll.Name(), idx.key, err)
+		}
+	}
+
+	// Expired idempotency keys are removed by MongoDB's TTL monitor
+	_, err := s.idemKeys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println("Could not create TTL index on idempotency_keys:", err)
+	}
+
+	// Expired sessions too, and sessions are listed per user
+	for _, coll := range []*mongo.Collection{s.sessions, s.customerSessions.coll} {
+		_, err = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{primitive.E{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+			{Keys: bson.D{primitive.E{Key: "username", Value: 1}}},
+		})
+		if err != nil {
+			log.Printf("Could not create indexes on %s: %v", coll.Name(), err)
+		}
+	}
+
+	// Variant SKUs are unique across products; products without variants
+	// are left out of the index
+	_, err = s.products.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{primitive.E{Key: "variants.sku", Value: 1}},
+		Options: options.Index().SetName(skuIndexName).SetUnique(true).
+			SetPartialFilterExpression(bson.M{"variants.sku": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Println("Could not create unique index on products.variants.sku (duplicate SKUs?):", err)
+	}
+
+	// Coupon codes are unique; automatic promotions have none
+	_, err = s.promos.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		log.Println("Could not create unique index on promotions.code:", err)
+	}
+
+	// Unused magic links expire the same way
+	_, err = s.links.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println("Could not create TTL index on magic_links:", err)
+	}
+
+	// Customers list their own orders
+	for _, coll := range []*mongo.Collection{s.orders, s.delivered} {
+		_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{primitive.E{Key: "customerId", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		})
+		if err != nil {
+			log.Printf("Could not create customerId index on %s: %v", coll.Name(), err)
+		}
+	}
+
+	// The audit log is read newest first, optionally by actor or target
+	_, err = s.audit.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{primitive.E{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{primitive.E{Key: "actor", Value: 1}, primitive.E{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{primitive.E{Key: "target", Value: 1}, primitive.E{Key: "createdAt", Value: -1}}},
+	})
+	if err != nil {
+		log.Println("Could not create indexes on audit_log:", err)
+	}
+}
+
+// migrateMoney converts the plain number prices and totals stored before
+// Money existed into cents of the shop currency, rounding half away from
+// zero, and gives orders from before taxes a subtotal. Documents already
+// converted are left alone, so it is safe to run on every start.
+func (s *mongoStore) migrateMoney(ctx context.Context) error {
+	numeric := bson.A{"double", "int", "long", "decimal"}
+	// $round rounds half to even, so round the absolute value half up and
+	// put the sign back
+	cents := func(field string) bson.M {
+		return bson.M{"$multiply": bson.A{
+			bson.M{"$cond": bson.A{bson.M{"$lt": bson.A{field, 0}}, -1, 1}},
+			bson.M{"$floor": bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{bson.M{"$abs": field}, 100}}, 0.5}}},
+		}}
+	}
+	money := func(field string) bson.M {
+		return bson.M{"$cond": bson.A{
+			bson.M{"$in": bson.A{bson.M{"$type": field}, numeric}},
+			bson.M{
+				"cents":    bson.M{"$toLong": cents(field)},
+				"currency": shopCurrency,
+			},
+			field,
+		}}
+	}
+
+	result, err := s.products.UpdateMany(ctx,
+		bson.M{"price": bson.M{"$type": numeric}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"price": money("$price")}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("migrating product prices: %w", err)
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Converted %d product prices to cents", result.ModifiedCount)
+	}
+
+	for _, coll := range []*mongo.Collection{s.orders, s.delivered} {
+		result, err := coll.UpdateMany(ctx,
+			bson.M{"total": bson.M{"$type": numeric}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"total": money("$total"),
+				"items": bson.M{"$map": bson.M{
+					"input": "$items",
+					"as":    "item",
+					"in": bson.M{"$mergeObjects": bson.A{"$$item", bson.M{
+						"unitPrice": money("$$item.unitPrice"),
+						"lineTotal": money("$$item.lineTotal"),
+					}}},
+				}},
+			}}}},
+		)
+		if err != nil {
+			return fmt.Errorf("migrating %s totals: %w", coll.Name(), err)
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Converted %d %s totals to cents", result.ModifiedCount, coll.Name())
+		}
+
+		_, err = coll.UpdateMany(ctx,
+			bson.M{"subtotal": bson.M{"$exists": false}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"subtotal": "$total",
+				"tax":      Money{Currency: shopCurrency},
+			}}}},
+		)
+		if err != nil {
+			return fmt.Errorf("adding subtotals to %s: %w", coll.Name(), err)
+		}
+	}
+	return nil
+}
+
+// seedCounters makes sure every counter is at least the highest number
+// already in use, so sequences continue where the data left off
+func (s *mongoStore) seedCounters(ctx context.Context) error {
+	seeds := []struct {
+		name string
+		coll *mongo.Collection
+		key  string
+	}{
+		{orderIDSequence, s.orders, "orderId"},
+		{orderIDSequence, s.delivered, "orderId"},
+		{productIDSequence, s.products, "productId"},
+	}
+	for _, seed := range seeds {
+		var highest struct {
+			Value int `bson:"value"`
+		}
+		findOptions := options.FindOne().
+			SetSort(bson.D{primitive.E{Key: seed.key, Value: -1}}).
+			SetProjection(bson.M{"value": "$" + seed.key})
+		err := seed.coll.FindOne(ctx, bson.M{}, findOptions).Decode(&highest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		// $max never moves a counter backwards, so this is safe to run on every start
+		_, err = s.counters.UpdateOne(ctx,
+			bson.M{"_id": seed.name},
+			bson.M{"$max": bson.M{"seq": highest.Value}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedOrderNumbers reserves the numbers of orders placed before the
+// order_numbers collection existed. Numbers already reserved are kept, so
+// this is safe to run on every start.
+func (s *mongoStore) seedOrderNumbers(ctx context.Context) error {
+	// Created up front, as servers before 4.4 can't create collections
+	// inside a transaction
+	err := s.db.CreateCollection(ctx, s.orderNums.Name())
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+		return fmt.Errorf("creating %s: %w", s.orderNums.Name(), err)
+	}
+
+	for _, coll := range []*mongo.Collection{s.orders, s.delivered} {
+		cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"orderId": bson.M{"$exists": true}}}},
+			{{Key: "$project", Value: bson.M{"_id": "$orderId"}}},
+			{{Key: "$merge", Value: bson.M{"into": s.orderNums.Name(), "whenMatched": "keepExisting"}}},
+		})
+		if err != nil {
+			return fmt.Errorf("reserving %s numbers: %w", coll.Name(), err)
+		}
+		cursor.Close(ctx)
+	}
+	return nil
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s *mongoStore) ListProducts(ctx context.Context) ([]Product, error) {
+	cursor, err := s.products.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	productsList := []Product{}
+	if err := cursor.All(ctx, &productsList); err != nil {
+		return nil, err
+	}
+	return productsList, nil
+}
+
+func (s *mongoStore) GetProduct(ctx context.Context, id primitive.ObjectID) (Product, error) {
+	return s.findProduct(ctx, bson.M{"_id": id})
+}
+
+func (s *mongoStore) GetProductByProductID(ctx context.Context, productID int) (Product, error) {
+	return s.findProduct(ctx, bson.M{"productId": productID})
+}
+
+func (s *mongoStore) findProduct(ctx context.Context, filter bson.M) (Product, error) {
+	var product Product
+	err := s.products.FindOne(ctx, filter).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return Product{}, ErrNotFound
+	}
+	return product, err
+}
+
+func (s *mongoStore) InsertProducts(ctx context.Context, products ...Product) error {
+	docs := make([]interface{}, 0, len(products))
+	for _, p := range products {
+		docs = append(docs, p)
+	}
+	if _, err := s.products.InsertMany(ctx, docs); err != nil {
+		if isSKUConflict(err) {
+			return fmt.Errorf("%w: %v", ErrSKUExists, err)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %v", ErrDuplicateID, err)
+		}
+		return err
+	}
+
+	// Keep the counter ahead of numbers assigned by the caller, such as the
+	// default products
+	highest := 0
+	for _, p := range products {
+		if p.ProductID > highest {
+			highest = p.ProductID
+		}
+	}
+	_, err := s.counters.UpdateOne(ctx,
+		bson.M{"_id": productIDSequence},
+		bson.M{"$max": bson.M{"seq": highest}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) UpdateProduct(ctx context.Context, id primitive.ObjectID, update ProductUpdate) error {
+	set := bson.M{
+		"name":        update.Name,
+		"description": update.Description,
+		"price":       update.Price,
+		"variants":    update.Variants,
+		"category":    update.Category,
+	}
+
+	// Only update the image if a new one was provided
+	if update.Image != "" {
+		set["image"] = update.Image
+	}
+
+	result, err := s.products.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	if isSKUConflict(err) {
+		return fmt.Errorf("%w: %v", ErrSKUExists, err)
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// skuIndexName names the unique index on variant SKUs, so its duplicate key
+// errors can be told apart from those on product numbers
+const skuIndexName = "variants_sku_unique"
+
+// isSKUConflict reports whether err is a duplicate key on the SKU index
+func isSKUConflict(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), skuIndexName)
+}
+
+func (s *mongoStore) DeleteProduct(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.products.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) ListOrders(ctx context.Context) ([]Order, error) {
+	// Newest first
+	return s.findOrders(ctx, s.orders, bson.M{}, "createdAt")
+}
+
+func (s *mongoStore) ListDeliveredOrders(ctx context.Context) ([]Order, error) {
+	// Most recently delivered first
+	return s.findOrders(ctx, s.delivered, bson.M{}, "deliveredAt")
+}
+
+func (s *mongoStore) findOrders(ctx context.Context, coll *mongo.Collection, filter bson.M, sortKey string) ([]Order, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{primitive.E{Key: sortKey, Value: -1}})
+
+	cursor, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := []Order{}
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (s *mongoStore) GetOrder(ctx context.Context, id primitive.ObjectID) (Order, error) {
+	for _, coll := range []*mongo.Collection{s.orders, s.delivered} {
+		var order Order
+		err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&order)
+		if err == nil {
+			return order, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return Order{}, err
+		}
+	}
+	return Order{}, ErrNotFound
+}
+
+// InsertOrder first reserves the order number in order_numbers. The unique
+// indexes only cover one collection each; the reservation also keeps the
+// numbers of delivered orders from being reused.
+func (s *mongoStore) InsertOrder(ctx context.Context, order Order) error {
+	return s.withTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.orderNums.InsertOne(ctx, bson.M{"_id": order.OrderID})
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %v", ErrDuplicateID, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.orders.InsertOne(ctx, order); err != nil {
+			if !s.transactions {
+				// Give the number back by hand; in a transaction the abort does this
+				s.orderNums.DeleteOne(ctx, bson.M{"_id": order.OrderID})
+			}
+			if mongo.IsDuplicateKeyError(err) {
+				return fmt.Errorf("%w: %v", ErrDuplicateID, err)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// PlaceOrder counts the promotion uses, takes the order number and inserts
+// the order in one transaction. Without transactions it gives the uses back
+// by hand when a later step fails; the order number is then used up.
+func (s *mongoStore) PlaceOrder(ctx context.Context, order Order, promotions []primitive.ObjectID) (Order, error) {
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		redeemed := 0
+		release := func() {
+			if !s.transactions {
+				for _, id := range promotions[:redeemed] {
+					s.AddPromotionUses(ctx, id, -1)
+				}
+			}
+		}
+
+		for _, id := range promotions {
+			if err := s.AddPromotionUses(ctx, id, 1); err != nil {
+				release()
+				return promotionUnavailable(id, err)
+			}
+			redeemed++
+		}
+
+		var err error
+		order.OrderID, err = s.NextSequence(ctx, orderIDSequence)
+		if err == nil {
+			err = s.InsertOrder(ctx, order)
+		}
+		if err != nil {
+			release()
+		}
+		return err
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (s *mongoStore) UpdateOrderStatus(ctx context.Context, id primitive.ObjectID, change StatusChange) (Order, error) {
+	if change.To == StatusDelivered {
+		return s.moveToDelivered(ctx, id, change)
+	}
+
+	update := bson.M{"$set": bson.M{"status": change.To}, "$push": bson.M{"statusHistory": change}}
+	filter := bson.M{"_id": id, "status": change.From}
+	after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	// The order is either still active or, e.g. when refunding, already delivered
+	for _, coll := range []*mongo.Collection{s.orders, s.delivered} {
+		var order Order
+		err := coll.FindOneAndUpdate(ctx, filter, update, after).Decode(&order)
+		if err == nil {
+			return order, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return Order{}, err
+		}
+	}
+	return Order{}, s.statusChangeError(ctx, id)
+}
+
+// moveToDelivered moves an active order into the delivered collection in a
+// single transaction
+func (s *mongoStore) moveToDelivered(ctx context.Context, id primitive.ObjectID, change StatusChange) (Order, error) {
+	var order Order
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		order = Order{}
+		err := s.orders.FindOne(ctx, bson.M{"_id": id, "status": change.From}).Decode(&order)
+		if err == mongo.ErrNoDocuments {
+			return s.statusChangeError(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+
+		applyStatusChange(&order, change)
+
+		// Write the delivered copy first. Replacing makes a retried or
+		// repaired move harmless.
+		_, err = s.delivered.ReplaceOne(ctx, bson.M{"_id": id}, order, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+
+		// Only remove the active order if nobody changed its status meanwhile
+		result, err := s.orders.DeleteOne(ctx, bson.M{"_id": id, "status": change.From})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			if !s.transactions {
+				// Undo the delivered copy by hand; in a transaction the abort does this
+				s.delivered.DeleteOne(ctx, bson.M{"_id": id})
+			}
+			return ErrStatusConflict
+		}
+		return nil
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// statusChangeError explains why a conditional status update matched nothing
+func (s *mongoStore) statusChangeError(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.GetOrder(ctx, id); err != nil {
+		return err
+	}
+	return ErrStatusConflict
+}
+
+// NextSequence atomically increments the named counter in the counters collection
+func (s *mongoStore) NextSequence(ctx context.Context, name string) (int, error) {
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	err := s.counters.FindOneAndUpdate(ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+func (s *mongoStore) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	// The existing key can be released between our insert and find; try again then
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err := s.idemKeys.InsertOne(ctx, record)
+		if err == nil {
+			return record, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return IdempotencyRecord{}, err
+		}
+
+		var existing IdempotencyRecord
+		err = s.idemKeys.FindOne(ctx, bson.M{"_id": record.Key}).Decode(&existing)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return IdempotencyRecord{}, err
+		}
+		return existing, ErrIdempotencyKeyExists
+	}
+	return IdempotencyRecord{}, fmt.Errorf("idempotency key %q is changing too quickly", record.Key)
+}
+
+func (s *mongoStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.idemKeys.UpdateOne(ctx,
+		bson.M{"_id": record.Key, "owner": record.Owner},
+		bson.M{"$set": bson.M{"statusCode": record.StatusCode, "response": record.Response}})
+	return err
+}
+
+func (s *mongoStore) ReleaseIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.idemKeys.DeleteOne(ctx, bson.M{"_id": record.Key, "owner": record.Owner})
+	return err
+}
+
+func (s *mongoStore) ListUsers(ctx context.Context) ([]StaffUser, error) {
+	cursor, err := s.users.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []StaffUser{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *mongoStore) GetUser(ctx context.Context, username string) (StaffUser, error) {
+	var user StaffUser
+	err := s.users.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return StaffUser{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *mongoStore) InsertUser(ctx context.Context, user StaffUser) error {
+	_, err := s.users.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (s *mongoStore) UpdateUser(ctx context.Context, username string, update StaffUserUpdate) (StaffUser, error) {
+	set := bson.M{}
+	if update.Name != "" {
+		set["name"] = update.Name
+	}
+	if update.Role != "" {
+		set["role"] = update.Role
+	}
+	if update.PasswordHash != "" {
+		set["password"] = update.PasswordHash
+	}
+	if len(set) == 0 {
+		return s.GetUser(ctx, username)
+	}
+
+	var user StaffUser
+	err := s.users.FindOneAndUpdate(ctx,
+		bson.M{"username": username},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return StaffUser{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *mongoStore) UpdateUserTwoFactor(ctx context.Context, username string, version int, twoFactor TwoFactor) error {
+	filter := bson.M{"username": username, "twoFactor.version": version}
+	if version == 0 {
+		// Accounts from before 2FA have no settings at all
+		filter = bson.M{"username": username, "$or": bson.A{
+			bson.M{"twoFactor.version": 0},
+			bson.M{"twoFactor": bson.M{"$exists": false}},
+		}}
+	}
+
+	twoFactor.Version = version + 1
+	result, err := s.users.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"twoFactor": twoFactor}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorConflict
+	}
+	return nil
+}
+
+func (s *mongoStore) DeleteUser(ctx context.Context, username string) error {
+	result, err := s.users.DeleteOne(ctx, bson.M{"username": username})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// mongoSessions is a SessionStore backed by one collection
+type mongoSessions struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoStore) CustomerSessions() SessionStore {
+	return s.customerSessions
+}
+
+func (s *mongoSessions) InsertSession(ctx context.Context, session Session) error {
+	_, err := s.coll.InsertOne(ctx, session)
+	return err
+}
+
+func (s *mongoSessions) GetSession(ctx context.Context, id string) (Session, error) {
+	var session Session
+	err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *mongoSessions) TouchSession(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error {
+	result, err := s.coll.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"lastSeenAt": lastSeenAt, "expiresAt": expiresAt}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoSessions) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	cursor, err := s.coll.Find(ctx, bson.M{"username": username}, options.Find().SetSort(bson.M{"lastSeenAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	userSessions := []Session{}
+	if err := cursor.All(ctx, &userSessions); err != nil {
+		return nil, err
+	}
+	return userSessions, nil
+}
+
+func (s *mongoSessions) DeleteSession(ctx context.Context, id string) error {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoSessions) DeleteUserSessions(ctx context.Context, username, exceptID string) (int, error) {
+	filter := bson.M{"username": username}
+	if exceptID != "" {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+	result, err := s.coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+func (s *mongoSessions) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{"expiresAt": bson.M{"$lt": now}})
+	return err
+}
+
+func (s *mongoStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (LoginThrottle, error) {
+	// An update pipeline, so the counter can start over in the same atomic step
+	update := mongo.Pipeline{
+		{primitive.E{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$lastFailureAt", now.Add(-window)}},
+				bson.M{"$add": bson.A{"$failures", 1}},
+				1,
+			}},
+			"lastFailureAt": now,
+		}}},
+	}
+
+	var throttle LoginThrottle
+	err := s.throttles.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&throttle)
+	return throttle, err
+}
+
+func (s *mongoStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := s.throttles.FindOne(ctx, bson.M{"_id": key}).Decode(&throttle)
+	if err == mongo.ErrNoDocuments {
+		return LoginThrottle{}, ErrNotFound
+	}
+	return throttle, err
+}
+
+func (s *mongoStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	result, err := s.throttles.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) DeleteStaleLoginThrottles(ctx context.Context, before time.Time) error {
+	_, err := s.throttles.DeleteMany(ctx, bson.M{"lastFailureAt": bson.M{"$lt": before}})
+	return err
+}
+
+func (s *mongoStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	cursor, err := s.apiKeys.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{primitive.E{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *mongoStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	err := s.apiKeys.FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+func (s *mongoStore) InsertAPIKey(ctx context.Context, key APIKey) error {
+	_, err := s.apiKeys.InsertOne(ctx, key)
+	return err
+}
+
+func (s *mongoStore) DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.apiKeys.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) InsertCustomer(ctx context.Context, customer CustomerAccount) error {
+	_, err := s.customers.InsertOne(ctx, customer)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCustomerExists
+	}
+	return err
+}
+
+func (s *mongoStore) GetCustomerByEmail(ctx context.Context, email string) (CustomerAccount, error) {
+	var customer CustomerAccount
+	err := s.customers.FindOne(ctx, bson.M{"email": email}).Decode(&customer)
+	if err == mongo.ErrNoDocuments {
+		return CustomerAccount{}, ErrNotFound
+	}
+	return customer, err
+}
+
+func (s *mongoStore) UpdateCustomer(ctx context.Context, id primitive.ObjectID, update CustomerUpdate) (CustomerAccount, error) {
+	set := bson.M{}
+	if update.Name != "" {
+		set["name"] = update.Name
+	}
+	if update.Phone != "" {
+		set["phone"] = update.Phone
+	}
+	if update.Addresses != nil {
+		set["addresses"] = update.Addresses
+	}
+
+	var customer CustomerAccount
+	var err error
+	if len(set) == 0 {
+		err = s.customers.FindOne(ctx, bson.M{"_id": id}).Decode(&customer)
+	} else {
+		err = s.customers.FindOneAndUpdate(ctx,
+			bson.M{"_id": id},
+			bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&customer)
+	}
+	if err == mongo.ErrNoDocuments {
+		return CustomerAccount{}, ErrNotFound
+	}
+	return customer, err
+}
+
+func (s *mongoStore) ListCustomerOrders(ctx context.Context, customerID string) ([]Order, error) {
+	filter := bson.M{"customerId": customerID}
+	orders, err := s.findOrders(ctx, s.orders, filter, "createdAt")
+	if err != nil {
+		return nil, err
+	}
+	delivered, err := s.findOrders(ctx, s.delivered, filter, "createdAt")
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first across both collections
+	orders = append(orders, delivered...)
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	return orders, nil
+}
+
+// InsertMagicLink leaves expired links to the TTL index
+func (s *mongoStore) InsertMagicLink(ctx context.Context, link MagicLink) error {
+	_, err := s.links.InsertOne(ctx, link)
+	return err
+}
+
+func (s *mongoStore) ConsumeMagicLink(ctx context.Context, id string) (MagicLink, error) {
+	var link MagicLink
+	err := s.links.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		return MagicLink{}, ErrNotFound
+	}
+	return link, err
+}
+
+func (s *mongoStore) ListPromotions(ctx context.Context) ([]Promotion, error) {
+	cursor, err := s.promos.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	promotions := []Promotion{}
+	if err := cursor.All(ctx, &promotions); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+func (s *mongoStore) GetPromotion(ctx context.Context, id primitive.ObjectID) (Promotion, error) {
+	var promotion Promotion
+	err := s.promos.FindOne(ctx, bson.M{"_id": id}).Decode(&promotion)
+	if err == mongo.ErrNoDocuments {
+		return Promotion{}, ErrNotFound
+	}
+	return promotion, err
+}
+
+func (s *mongoStore) InsertPromotion(ctx context.Context, promotion Promotion) error {
+	_, err := s.promos.InsertOne(ctx, promotion)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPromotionExists
+	}
+	return err
+}
+
+func (s *mongoStore) UpdatePromotion(ctx context.Context, promotion Promotion) error {
+	// Replace everything but the use count, which orders update meanwhile.
+	// $literal keeps values such as "$5 off" from being read as fields.
+	replace := mongo.Pipeline{{{Key: "$replaceWith", Value: bson.M{"$mergeObjects": bson.A{
+		bson.M{"$literal": promotion},
+		bson.M{"uses": "$uses"},
+	}}}}}
+	result, err := s.promos.UpdateOne(ctx, bson.M{"_id": promotion.ID}, replace)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPromotionExists
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) DeletePromotion(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.promos.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) AddPromotionUses(ctx context.Context, id primitive.ObjectID, n int) error {
+	filter := bson.M{"_id": id}
+	if n > 0 {
+		filter["$or"] = bson.A{
+			bson.M{"maxUses": 0},
+			bson.M{"$expr": bson.M{"$lte": bson.A{bson.M{"$add": bson.A{"$uses", n}}, "$maxUses"}}},
+		}
+	}
+	result, err := s.promos.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"uses": n}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := s.GetPromotion(ctx, id); err != nil {
+			return err
+		}
+		return ErrPromotionUsedUp
+	}
+	return nil
+}
+
+func (s *mongoStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := s.audit.InsertOne(ctx, entry)
+	return err
+}
+
+func (s *mongoStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error) {
+	query := bson.M{}
+	for field, value := range map[string]string{"action": filter.Action, "actor": filter.Actor, "target": filter.Target} {
+		if value != "" {
+			query[field] = value
+		}
+	}
+	createdAt := bson.M{}
+	if !filter.Since.IsZero() {
+		createdAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		createdAt["$lt"] = filter.Until
+	}
+	if len(createdAt) > 0 {
+		query["createdAt"] = createdAt
+	}
+
+	total, err := s.audit.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{primitive.E{Key: "createdAt", Value: -1}}).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit))
+	cursor, err := s.audit.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, int(total), nil
+}
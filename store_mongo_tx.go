@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// detectTransactions reports whether the deployment supports multi-document
+// transactions, which need a replica set or a sharded cluster
+func detectTransactions(ctx context.Context, client *mongo.Client) bool {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		log.Println("Could not detect MongoDB topology, transactions disabled:", err)
+		return false
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid"
+}
+
+// withTransaction runs fn inside a session transaction. The driver retries
+// the whole callback on transient transaction errors and retries the commit
+// when its outcome is unknown, until ctx expires.
+//
+// Inside another withTransaction, fn joins the running transaction.
+//
+// On a standalone server there are no transactions; fn then runs directly
+// and must order its writes so that an interruption can be repaired, see
+// repairInterruptedMoves, or undo them itself.
+func (s *mongoStore) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !s.transactions || mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	txnOptions := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	}, txnOptions)
+	return err
+}
+
+// repairInterruptedMoves finishes moves into the delivered collection that
+// were interrupted between their two writes. Without transactions the
+// delivered copy is always written first, so an order found in both
+// collections has been delivered and only its active copy is left to remove.
+func (s *mongoStore) repairInterruptedMoves(ctx context.Context) error {
+	cursor, err := s.orders.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var active []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &active); err != nil {
+		return err
+	}
+	if len(active) == 0 {
+		return nil
+	}
+
+	ids := make([]interface{}, 0, len(active))
+	for _, a := range active {
+		ids = append(ids, a.ID)
+	}
+	cursor, err = s.delivered.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var moved []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &moved); err != nil {
+		return err
+	}
+
+	for _, m := range moved {
+		if _, err := s.orders.DeleteOne(ctx, bson.M{"_id": m.ID}); err != nil {
+			return err
+		}
+		log.Printf("Removed order %v from active orders; it had already been delivered", m.ID)
+	}
+	return nil
+}
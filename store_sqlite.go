@@ -0,0 +1,1450 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteMigrations are applied in order on startup. Each entry is one schema
+// version; never edit an entry once released, append a new one instead.
+var sqliteMigrations = []string{
+	// 1: products, active orders and delivered orders
+	`CREATE TABLE products (
+		id          TEXT PRIMARY KEY,
+		product_id  INTEGER NOT NULL,
+		name        TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		price       REAL NOT NULL,
+		image       TEXT NOT NULL DEFAULT '',
+		category    TEXT NOT NULL DEFAULT '',
+		created_at  DATETIME
+	);
+	CREATE INDEX products_product_id ON products (product_id);
+
+	CREATE TABLE orders (
+		id           TEXT PRIMARY KEY,
+		order_id     INTEGER NOT NULL,
+		customer     TEXT NOT NULL,
+		items        TEXT NOT NULL,
+		total        REAL NOT NULL,
+		status       TEXT NOT NULL,
+		created_at   DATETIME NOT NULL,
+		delivered_at DATETIME
+	);
+	CREATE INDEX orders_created_at ON orders (created_at);
+
+	CREATE TABLE delivered (
+		id           TEXT PRIMARY KEY,
+		order_id     INTEGER NOT NULL,
+		customer     TEXT NOT NULL,
+		items        TEXT NOT NULL,
+		total        REAL NOT NULL,
+		status       TEXT NOT NULL,
+		created_at   DATETIME NOT NULL,
+		delivered_at DATETIME
+	);
+	CREATE INDEX delivered_delivered_at ON delivered (delivered_at);`,
+
+	// 2: order status history
+	`ALTER TABLE orders ADD COLUMN status_history TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE delivered ADD COLUMN status_history TEXT NOT NULL DEFAULT '[]';`,
+
+	// 3: atomic counters seeded from the numbers in use, and unique numbers
+	`CREATE TABLE counters (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	INSERT INTO counters (name, value)
+		SELECT 'orderId', COALESCE(MAX(order_id), 0)
+		FROM (SELECT order_id FROM orders UNION ALL SELECT order_id FROM delivered);
+	INSERT INTO counters (name, value)
+		SELECT 'productId', COALESCE(MAX(product_id), 0) FROM products;
+
+	DROP INDEX products_product_id;
+	CREATE UNIQUE INDEX products_product_id ON products (product_id);
+	CREATE UNIQUE INDEX orders_order_id ON orders (order_id);
+	CREATE UNIQUE INDEX delivered_order_id ON delivered (order_id);`,
+
+	// 4: idempotency keys
+	`CREATE TABLE idempotency_keys (
+		key          TEXT PRIMARY KEY,
+		owner        TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code  INTEGER NOT NULL DEFAULT 0,
+		response     BLOB,
+		created_at   DATETIME NOT NULL,
+		expires_at   DATETIME NOT NULL
+	);
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);`,
+
+	// 5: staff users
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL UNIQUE,
+		name       TEXT NOT NULL DEFAULT '',
+		role       TEXT NOT NULL,
+		password   TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 6: login sessions
+	`CREATE TABLE sessions (
+		id           TEXT PRIMARY KEY,
+		username     TEXT NOT NULL,
+		role         TEXT NOT NULL,
+		user_agent   TEXT NOT NULL DEFAULT '',
+		ip           TEXT NOT NULL DEFAULT '',
+		created_at   DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		expires_at   DATETIME NOT NULL
+	);
+	CREATE INDEX sessions_username ON sessions (username);
+	CREATE INDEX sessions_expires_at ON sessions (expires_at);`,
+
+	// 7: failed login counters and the audit log
+	`CREATE TABLE login_throttles (
+		key             TEXT PRIMARY KEY,
+		failures        INTEGER NOT NULL,
+		last_failure_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE audit_log (
+		id         TEXT PRIMARY KEY,
+		action     TEXT NOT NULL,
+		actor      TEXT NOT NULL DEFAULT '',
+		target     TEXT NOT NULL DEFAULT '',
+		ip         TEXT NOT NULL DEFAULT '',
+		details    TEXT,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX audit_log_created_at ON audit_log (created_at);`,
+
+	// 8: two-factor authentication
+	`ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_recovery_codes TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE users ADD COLUMN totp_last_counter INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_version INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN two_factor_pending INTEGER NOT NULL DEFAULT 0;`,
+
+	// 9: API keys
+	`CREATE TABLE api_keys (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		prefix     TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		scopes     TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME
+	);`,
+
+	// 10: before and after values in the audit log
+	`ALTER TABLE audit_log ADD COLUMN before_value TEXT;
+	ALTER TABLE audit_log ADD COLUMN after_value TEXT;
+	CREATE INDEX audit_log_actor ON audit_log (actor, created_at);
+	CREATE INDEX audit_log_target ON audit_log (target, created_at);`,
+
+	// 11: customer accounts, linked to their orders
+	`CREATE TABLE customers (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL UNIQUE,
+		name       TEXT NOT NULL DEFAULT '',
+		phone      TEXT NOT NULL DEFAULT '',
+		addresses  TEXT NOT NULL DEFAULT '[]',
+		password   TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	ALTER TABLE orders ADD COLUMN customer_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE delivered ADD COLUMN customer_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX orders_customer_id ON orders (customer_id);
+	CREATE INDEX delivered_customer_id ON delivered (customer_id);`,
+
+	// 12: databases created before InsertProducts raised the counter
+	`UPDATE counters SET value = MAX(value, (SELECT COALESCE(MAX(product_id), 0) FROM products))
+	WHERE name = 'productId';`,
+
+	// 13: customer sessions, apart from staff sessions, and magic links
+	`CREATE TABLE customer_sessions (
+		id                 TEXT PRIMARY KEY,
+		username           TEXT NOT NULL,
+		role               TEXT NOT NULL,
+		user_agent         TEXT NOT NULL DEFAULT '',
+		ip                 TEXT NOT NULL DEFAULT '',
+		created_at         DATETIME NOT NULL,
+		last_seen_at       DATETIME NOT NULL,
+		expires_at         DATETIME NOT NULL,
+		two_factor_pending INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX customer_sessions_username ON customer_sessions (username);
+	CREATE INDEX customer_sessions_expires_at ON customer_sessions (expires_at);
+	DELETE FROM sessions WHERE role = 'customer';
+
+	CREATE TABLE magic_links (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX magic_links_expires_at ON magic_links (expires_at);`,
+
+	// 14: money in whole cents with a currency instead of floats. Amounts
+	// are rounded half away from zero to the cent.
+	`ALTER TABLE products ADD COLUMN price_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD';
+	UPDATE products SET price_cents = CAST(ROUND(price * 100) AS INTEGER);
+	ALTER TABLE products DROP COLUMN price;
+
+	ALTER TABLE orders ADD COLUMN total_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD';
+	UPDATE orders SET total_cents = CAST(ROUND(total * 100) AS INTEGER),
+		items = (SELECT json_group_array(json_patch(value, json_object(
+			'unitPrice', json_object('cents', CAST(ROUND(json_extract(value, '$.unitPrice') * 100) AS INTEGER), 'currency', 'USD'),
+			'lineTotal', json_object('cents', CAST(ROUND(json_extract(value, '$.lineTotal') * 100) AS INTEGER), 'currency', 'USD'))))
+			FROM json_each(orders.items));
+	ALTER TABLE orders DROP COLUMN total;
+
+	ALTER TABLE delivered ADD COLUMN total_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE delivered ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD';
+	UPDATE delivered SET total_cents = CAST(ROUND(total * 100) AS INTEGER),
+		items = (SELECT json_group_array(json_patch(value, json_object(
+			'unitPrice', json_object('cents', CAST(ROUND(json_extract(value, '$.unitPrice') * 100) AS INTEGER), 'currency', 'USD'),
+			'lineTotal', json_object('cents', CAST(ROUND(json_extract(value, '$.lineTotal') * 100) AS INTEGER), 'currency', 'USD'))))
+			FROM json_each(delivered.items));
+	ALTER TABLE delivered DROP COLUMN total;`,
+
+	// 15: tax breakdown of orders; older orders were not taxed
+	`ALTER TABLE orders ADD COLUMN fulfillment TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN subtotal_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN tax_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN tax_included INTEGER NOT NULL DEFAULT 0;
+	UPDATE orders SET subtotal_cents = total_cents;
+
+	ALTER TABLE delivered ADD COLUMN fulfillment TEXT NOT NULL DEFAULT '';
+	ALTER TABLE delivered ADD COLUMN subtotal_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE delivered ADD COLUMN tax_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE delivered ADD COLUMN tax_included INTEGER NOT NULL DEFAULT 0;
+	UPDATE delivered SET subtotal_cents = total_cents;`,
+
+	// 16: promotions and coupons, and the discounts on orders
+	`CREATE TABLE promotions (
+		id         TEXT PRIMARY KEY,
+		code       TEXT UNIQUE,
+		definition TEXT NOT NULL,
+		max_uses   INTEGER NOT NULL DEFAULT 0,
+		uses       INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+
+	ALTER TABLE orders ADD COLUMN discount_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN discounts TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE orders ADD COLUMN coupon_code TEXT NOT NULL DEFAULT '';
+
+	ALTER TABLE delivered ADD COLUMN discount_cents INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE delivered ADD COLUMN discounts TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE delivered ADD COLUMN coupon_code TEXT NOT NULL DEFAULT '';`,
+
+	// 17: product variants, as a JSON array
+	`ALTER TABLE products ADD COLUMN variants TEXT NOT NULL DEFAULT '[]';`,
+
+	// 18: order numbers taken by active and delivered orders alike; the
+	// unique indexes only cover one table each
+	`CREATE TABLE order_numbers (
+		order_id INTEGER PRIMARY KEY
+	);
+	INSERT OR IGNORE INTO order_numbers (order_id)
+		SELECT order_id FROM orders UNION SELECT order_id FROM delivered;`,
+
+	// 19: variant SKUs, unique across all products
+	`CREATE TABLE product_skus (
+		sku        TEXT PRIMARY KEY,
+		product_id TEXT NOT NULL
+	);
+	CREATE INDEX product_skus_product_id ON product_skus (product_id);
+	INSERT OR IGNORE INTO product_skus (sku, product_id)
+		SELECT json_extract(value, '$.sku'), products.id FROM products, json_each(products.variants);`,
+}
+
+// sqliteStore is the embedded SQLite implementation of Store
+type sqliteStore struct {
+	db *sql.DB
+
+	// Staff sessions, and customer sessions kept apart from them
+	*sqliteSessions
+	customerSessions *sqliteSessions
+}
+
+// newSQLiteStore opens (or creates) the database file at path and migrates it
+// to the latest schema
+func newSQLiteStore(ctx context.Context, path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer; serialising connections avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{
+		db:               db,
+		sqliteSessions:   &sqliteSessions{db: db, table: "sessions"},
+		customerSessions: &sqliteSessions{db: db, table: "customer_sessions"},
+	}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite schema: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies every migration newer than the recorded schema version
+func (s *sqliteStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(sqliteMigrations); i++ {
+		version := i + 1
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// withTx runs fn inside a transaction, committing on success
+func (s *sqliteStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+const productColumns = `id, product_id, name, description, price_cents, currency, variants, image, category, created_at`
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row scanner) (Product, error) {
+	var (
+		p         Product
+		id        string
+		variants  string
+		createdAt sql.NullTime
+	)
+	if err := row.Scan(&id, &p.ProductID, &p.Name, &p.Description, &p.Price.Cents, &p.Price.Currency, &variants, &p.Image, &p.Category, &createdAt); err != nil {
+		return Product{}, err
+	}
+	if err := json.Unmarshal([]byte(variants), &p.Variants); err != nil {
+		return Product{}, err
+	}
+	p.ID, _ = primitive.ObjectIDFromHex(id)
+	p.CreatedAt = createdAt.Time
+	return p, nil
+}
+
+func (s *sqliteStore) ListProducts(ctx context.Context) ([]Product, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+productColumns+` FROM products ORDER BY product_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	productsList := []Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		productsList = append(productsList, p)
+	}
+	return productsList, rows.Err()
+}
+
+func (s *sqliteStore) GetProduct(ctx context.Context, id primitive.ObjectID) (Product, error) {
+	return s.findProduct(ctx, `id = ?`, id.Hex())
+}
+
+func (s *sqliteStore) GetProductByProductID(ctx context.Context, productID int) (Product, error) {
+	return s.findProduct(ctx, `product_id = ?`, productID)
+}
+
+func (s *sqliteStore) findProduct(ctx context.Context, where string, arg interface{}) (Product, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE `+where, arg)
+	p, err := scanProduct(row)
+	if err == sql.ErrNoRows {
+		return Product{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *sqliteStore) InsertProducts(ctx context.Context, products ...Product) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, p := range products {
+			variants, err := marshalVariants(p.Variants)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO products (`+productColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				p.ID.Hex(), p.ProductID, p.Name, p.Description, p.Price.Cents, p.Price.Currency, variants, p.Image, p.Category, p.CreatedAt)
+			if err != nil {
+				return duplicateID(err)
+			}
+			if err := insertSQLiteSKUs(ctx, tx, p.ID, p.Variants); err != nil {
+				return err
+			}
+
+			// Keep the counter ahead of numbers assigned by the caller,
+			// such as the default products
+			_, err = tx.ExecContext(ctx, `INSERT INTO counters (name, value) VALUES (?, ?)
+				ON CONFLICT (name) DO UPDATE SET value = MAX(value, excluded.value)`, productIDSequence, p.ProductID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) UpdateProduct(ctx context.Context, id primitive.ObjectID, update ProductUpdate) error {
+	variants, err := marshalVariants(update.Variants)
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		// Only update the image if a new one was provided
+		result, err := tx.ExecContext(ctx, `UPDATE products
+			SET name = ?, description = ?, price_cents = ?, currency = ?, variants = ?, category = ?, image = COALESCE(NULLIF(?, ''), image)
+			WHERE id = ?`,
+			update.Name, update.Description, update.Price.Cents, update.Price.Currency, variants, update.Category, update.Image, id.Hex())
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result); err != nil {
+			return err
+		}
+
+		// The variants are replaced, and their SKUs with them
+		if _, err := tx.ExecContext(ctx, `DELETE FROM product_skus WHERE product_id = ?`, id.Hex()); err != nil {
+			return err
+		}
+		return insertSQLiteSKUs(ctx, tx, id, update.Variants)
+	})
+}
+
+// insertSQLiteSKUs claims the variants' SKUs for product id, or returns
+// ErrSKUExists if another product has one of them
+func insertSQLiteSKUs(ctx context.Context, tx *sql.Tx, id primitive.ObjectID, variants []ProductVariant) error {
+	for _, v := range variants {
+		_, err := tx.ExecContext(ctx, `INSERT INTO product_skus (sku, product_id) VALUES (?, ?)`, v.SKU, id.Hex())
+		if errors.Is(duplicateID(err), ErrDuplicateID) {
+			return fmt.Errorf("%w: %s", ErrSKUExists, v.SKU)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalVariants encodes variants for the variants column; none is "[]"
+func marshalVariants(variants []ProductVariant) (string, error) {
+	if variants == nil {
+		variants = []ProductVariant{}
+	}
+	data, err := json.Marshal(variants)
+	return string(data), err
+}
+
+func (s *sqliteStore) DeleteProduct(ctx context.Context, id primitive.ObjectID) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `DELETE FROM products WHERE id = ?`, id.Hex())
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM product_skus WHERE product_id = ?`, id.Hex())
+		return err
+	})
+}
+
+// requireAffected turns an UPDATE or DELETE that matched no rows into ErrNotFound
+func requireAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const orderColumns = `id, order_id, customer, items, total_cents, currency, status, created_at, delivered_at, status_history, customer_id,
+	fulfillment, subtotal_cents, tax_cents, tax_included, discount_cents, discounts, coupon_code`
+
+// orderPlaceholders has one placeholder per column in orderColumns
+const orderPlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+
+func scanOrder(row scanner) (Order, error) {
+	var (
+		o           Order
+		id          string
+		customer    string
+		items       string
+		deliveredAt sql.NullTime
+		history     string
+		discounts   string
+	)
+	if err := row.Scan(&id, &o.OrderID, &customer, &items, &o.Total.Cents, &o.Total.Currency, &o.Status, &o.CreatedAt, &deliveredAt, &history, &o.CustomerID,
+		&o.Fulfillment, &o.Subtotal.Cents, &o.Tax.Cents, &o.TaxIncluded, &o.Discount.Cents, &discounts, &o.CouponCode); err != nil {
+		return Order{}, err
+	}
+	o.ID, _ = primitive.ObjectIDFromHex(id)
+	o.Subtotal.Currency = o.Total.Currency
+	o.Tax.Currency = o.Total.Currency
+	o.Discount.Currency = o.Total.Currency
+	if err := json.Unmarshal([]byte(discounts), &o.Discounts); err != nil {
+		return Order{}, err
+	}
+	if err := json.Unmarshal([]byte(customer), &o.Customer); err != nil {
+		return Order{}, err
+	}
+	if err := json.Unmarshal([]byte(items), &o.Items); err != nil {
+		return Order{}, err
+	}
+	if err := json.Unmarshal([]byte(history), &o.StatusHistory); err != nil {
+		return Order{}, err
+	}
+	if deliveredAt.Valid {
+		o.DeliveredAt = &deliveredAt.Time
+	}
+	return o, nil
+}
+
+// orderArgs returns the column values of an order in orderColumns order
+func orderArgs(o Order) ([]interface{}, error) {
+	customer, err := json.Marshal(o.Customer)
+	if err != nil {
+		return nil, err
+	}
+	items, err := json.Marshal(o.Items)
+	if err != nil {
+		return nil, err
+	}
+	history, err := json.Marshal(o.StatusHistory)
+	if err != nil {
+		return nil, err
+	}
+	discounts, err := json.Marshal(o.Discounts)
+	if err != nil {
+		return nil, err
+	}
+	var deliveredAt interface{}
+	if o.DeliveredAt != nil {
+		deliveredAt = *o.DeliveredAt
+	}
+	return []interface{}{o.ID.Hex(), o.OrderID, string(customer), string(items), o.Total.Cents, o.Total.Currency, o.Status, o.CreatedAt, deliveredAt, string(history), o.CustomerID,
+		o.Fulfillment, o.Subtotal.Cents, o.Tax.Cents, o.TaxIncluded, o.Discount.Cents, string(discounts), o.CouponCode}, nil
+}
+
+func (s *sqliteStore) ListOrders(ctx context.Context) ([]Order, error) {
+	// Newest first
+	return s.findOrders(ctx, `SELECT `+orderColumns+` FROM orders ORDER BY created_at DESC`)
+}
+
+func (s *sqliteStore) ListDeliveredOrders(ctx context.Context) ([]Order, error) {
+	// Most recently delivered first
+	return s.findOrders(ctx, `SELECT `+orderColumns+` FROM delivered ORDER BY delivered_at DESC`)
+}
+
+func (s *sqliteStore) findOrders(ctx context.Context, query string, args ...interface{}) ([]Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (s *sqliteStore) GetOrder(ctx context.Context, id primitive.ObjectID) (Order, error) {
+	o, _, err := getSQLiteOrder(ctx, s.db, id)
+	return o, err
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// getSQLiteOrder looks the order up in the orders and then the delivered
+// table, and returns the name of the table it was found in
+func getSQLiteOrder(ctx context.Context, q queryer, id primitive.ObjectID) (Order, string, error) {
+	for _, table := range []string{"orders", "delivered"} {
+		o, err := scanOrder(q.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM `+table+` WHERE id = ?`, id.Hex()))
+		if err == nil {
+			return o, table, nil
+		}
+		if err != sql.ErrNoRows {
+			return Order{}, "", err
+		}
+	}
+	return Order{}, "", ErrNotFound
+}
+
+func (s *sqliteStore) InsertOrder(ctx context.Context, order Order) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return insertNewSQLiteOrder(ctx, tx, order)
+	})
+}
+
+// PlaceOrder counts the promotion uses, takes the order number and inserts
+// the order in one transaction
+func (s *sqliteStore) PlaceOrder(ctx context.Context, order Order, promotions []primitive.ObjectID) (Order, error) {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, id := range promotions {
+			if err := addSQLitePromotionUses(ctx, tx, id, 1); err != nil {
+				return promotionUnavailable(id, err)
+			}
+		}
+		var err error
+		order.OrderID, err = nextSQLiteSequence(ctx, tx, orderIDSequence)
+		if err != nil {
+			return err
+		}
+		return insertNewSQLiteOrder(ctx, tx, order)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// insertNewSQLiteOrder reserves the order number in order_numbers, so
+// delivered orders' numbers are never reused, and inserts the order
+func insertNewSQLiteOrder(ctx context.Context, tx *sql.Tx, order Order) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO order_numbers (order_id) VALUES (?)`, order.OrderID)
+	if err != nil {
+		return duplicateID(err)
+	}
+	return insertSQLiteOrder(ctx, tx, "orders", order)
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execQueryer is implemented by *sql.DB and *sql.Tx
+type execQueryer interface {
+	execer
+	queryer
+}
+
+func insertSQLiteOrder(ctx context.Context, e execer, table string, order Order) error {
+	args, err := orderArgs(order)
+	if err != nil {
+		return err
+	}
+	_, err = e.ExecContext(ctx, `INSERT INTO `+table+` (`+orderColumns+`) VALUES (`+orderPlaceholders+`)`, args...)
+	return duplicateID(err)
+}
+
+// duplicateID turns a unique constraint violation into ErrDuplicateID
+func duplicateID(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %v", ErrDuplicateID, err)
+		}
+	}
+	return err
+}
+
+func (s *sqliteStore) UpdateOrderStatus(ctx context.Context, id primitive.ObjectID, change StatusChange) (Order, error) {
+	var order Order
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var (
+			table string
+			err   error
+		)
+		order, table, err = getSQLiteOrder(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if order.Status != change.From {
+			return ErrStatusConflict
+		}
+
+		applyStatusChange(&order, change)
+
+		// Delivered orders move to the delivered table
+		if change.To == StatusDelivered && table == "orders" {
+			if err := insertSQLiteOrder(ctx, tx, "delivered", order); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM orders WHERE id = ?`, id.Hex())
+			return err
+		}
+
+		history, err := json.Marshal(order.StatusHistory)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET status = ?, status_history = ? WHERE id = ?`,
+			order.Status, string(history), id.Hex())
+		return err
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (s *sqliteStore) NextSequence(ctx context.Context, name string) (int, error) {
+	return nextSQLiteSequence(ctx, s.db, name)
+}
+
+// nextSQLiteSequence increments the named counter in a single statement
+func nextSQLiteSequence(ctx context.Context, q queryer, name string) (int, error) {
+	var value int
+	err := q.QueryRowContext(ctx, `INSERT INTO counters (name, value) VALUES (?, 1)
+		ON CONFLICT (name) DO UPDATE SET value = value + 1
+		RETURNING value`, name).Scan(&value)
+	return value, err
+}
+
+func (s *sqliteStore) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	var existing IdempotencyRecord
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// Sweep expired keys
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < ?`, time.Now()); err != nil {
+			return err
+		}
+
+		err := tx.QueryRowContext(ctx, `SELECT key, owner, request_hash, status_code, response, created_at, expires_at
+			FROM idempotency_keys WHERE key = ?`, record.Key).
+			Scan(&existing.Key, &existing.Owner, &existing.RequestHash, &existing.StatusCode, &existing.Response, &existing.CreatedAt, &existing.ExpiresAt)
+		if err == nil {
+			return ErrIdempotencyKeyExists
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		existing = record
+		_, err = tx.ExecContext(ctx, `INSERT INTO idempotency_keys (key, owner, request_hash, created_at, expires_at)
+			VALUES (?, ?, ?, ?, ?)`, record.Key, record.Owner, record.RequestHash, record.CreatedAt, record.ExpiresAt)
+		return err
+	})
+	return existing, err
+}
+
+func (s *sqliteStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = ?, response = ? WHERE key = ? AND owner = ?`,
+		record.StatusCode, record.Response, record.Key, record.Owner)
+	return err
+}
+
+func (s *sqliteStore) ReleaseIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = ? AND owner = ?`, record.Key, record.Owner)
+	return err
+}
+
+const userColumns = `id, username, name, role, password, created_at,
+	totp_enabled, totp_secret, totp_recovery_codes, totp_last_counter, totp_version`
+
+func scanUser(row scanner) (StaffUser, error) {
+	var (
+		u  StaffUser
+		id string
+	)
+	var recoveryCodes string
+	if err := row.Scan(&id, &u.Username, &u.Name, &u.Role, &u.PasswordHash, &u.CreatedAt,
+		&u.TwoFactor.Enabled, &u.TwoFactor.Secret, &recoveryCodes, &u.TwoFactor.LastCounter, &u.TwoFactor.Version); err != nil {
+		return StaffUser{}, err
+	}
+	u.ID, _ = primitive.ObjectIDFromHex(id)
+	if err := json.Unmarshal([]byte(recoveryCodes), &u.TwoFactor.RecoveryCodes); err != nil {
+		return StaffUser{}, err
+	}
+	return u, nil
+}
+
+func (s *sqliteStore) ListUsers(ctx context.Context) ([]StaffUser, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []StaffUser{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteStore) GetUser(ctx context.Context, username string) (StaffUser, error) {
+	return getSQLiteUser(ctx, s.db, username)
+}
+
+func getSQLiteUser(ctx context.Context, q queryer, username string) (StaffUser, error) {
+	u, err := scanUser(q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if err == sql.ErrNoRows {
+		return StaffUser{}, ErrNotFound
+	}
+	return u, err
+}
+
+func (s *sqliteStore) InsertUser(ctx context.Context, user StaffUser) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)`, user.Username).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrUserExists
+		}
+		recoveryCodes, err := json.Marshal(user.TwoFactor.RecoveryCodes)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			user.ID.Hex(), user.Username, user.Name, user.Role, user.PasswordHash, user.CreatedAt,
+			user.TwoFactor.Enabled, user.TwoFactor.Secret, string(recoveryCodes), user.TwoFactor.LastCounter, user.TwoFactor.Version)
+		return err
+	})
+}
+
+func (s *sqliteStore) UpdateUser(ctx context.Context, username string, update StaffUserUpdate) (StaffUser, error) {
+	var user StaffUser
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// Empty fields keep their current value
+		result, err := tx.ExecContext(ctx, `UPDATE users
+			SET name = COALESCE(NULLIF(?, ''), name),
+				role = COALESCE(NULLIF(?, ''), role),
+				password = COALESCE(NULLIF(?, ''), password)
+			WHERE username = ?`,
+			update.Name, update.Role, update.PasswordHash, username)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result); err != nil {
+			return err
+		}
+		user, err = getSQLiteUser(ctx, tx, username)
+		return err
+	})
+	return user, err
+}
+
+func (s *sqliteStore) UpdateUserTwoFactor(ctx context.Context, username string, version int, twoFactor TwoFactor) error {
+	recoveryCodes, err := json.Marshal(twoFactor.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `UPDATE users
+		SET totp_enabled = ?, totp_secret = ?, totp_recovery_codes = ?, totp_last_counter = ?, totp_version = ?
+		WHERE username = ? AND totp_version = ?`,
+		twoFactor.Enabled, twoFactor.Secret, string(recoveryCodes), twoFactor.LastCounter, version+1,
+		username, version)
+	if err != nil {
+		return err
+	}
+	err = requireAffected(result)
+	if errors.Is(err, ErrNotFound) {
+		return ErrTwoFactorConflict
+	}
+	return err
+}
+
+func (s *sqliteStore) DeleteUser(ctx context.Context, username string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+const sessionColumns = `id, username, role, user_agent, ip, created_at, last_seen_at, expires_at, two_factor_pending`
+
+func scanSession(row scanner) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.Username, &session.Role, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.TwoFactorPending)
+	return session, err
+}
+
+// sqliteSessions is a SessionStore backed by one table
+type sqliteSessions struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *sqliteStore) CustomerSessions() SessionStore {
+	return s.customerSessions
+}
+
+func (s *sqliteSessions) InsertSession(ctx context.Context, session Session) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.table+` (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.Username, session.Role, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt, session.TwoFactorPending)
+	return err
+}
+
+func (s *sqliteSessions) GetSession(ctx context.Context, id string) (Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM `+s.table+` WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *sqliteSessions) TouchSession(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE `+s.table+` SET last_seen_at = ?, expires_at = ? WHERE id = ?`,
+		lastSeenAt, expiresAt, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (s *sqliteSessions) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sessionColumns+` FROM `+s.table+`
+		WHERE username = ? ORDER BY last_seen_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userSessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		userSessions = append(userSessions, session)
+	}
+	return userSessions, rows.Err()
+}
+
+func (s *sqliteSessions) DeleteSession(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (s *sqliteSessions) DeleteUserSessions(ctx context.Context, username, exceptID string) (int, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE username = ? AND id != ?`, username, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteSessions) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE expires_at < ?`, now)
+	return err
+}
+
+func (s *sqliteStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (LoginThrottle, error) {
+	throttle := LoginThrottle{Key: key}
+	err := s.db.QueryRowContext(ctx, `INSERT INTO login_throttles (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN last_failure_at >= ? THEN failures + 1 ELSE 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures, last_failure_at`, key, now, now.Add(-window)).
+		Scan(&throttle.Failures, &throttle.LastFailureAt)
+	return throttle, err
+}
+
+func (s *sqliteStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	throttle := LoginThrottle{Key: key}
+	err := s.db.QueryRowContext(ctx, `SELECT failures, last_failure_at FROM login_throttles WHERE key = ?`, key).
+		Scan(&throttle.Failures, &throttle.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return LoginThrottle{}, ErrNotFound
+	}
+	return throttle, err
+}
+
+func (s *sqliteStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM login_throttles WHERE key = ?`, key)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (s *sqliteStore) DeleteStaleLoginThrottles(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM login_throttles WHERE last_failure_at < ?`, before)
+	return err
+}
+
+const apiKeyColumns = `id, name, prefix, hash, scopes, created_by, created_at, expires_at`
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	var (
+		key       APIKey
+		id        string
+		scopes    string
+		expiresAt sql.NullTime
+	)
+	if err := row.Scan(&id, &key.Name, &key.Prefix, &key.Hash, &scopes, &key.CreatedBy, &key.CreatedAt, &expiresAt); err != nil {
+		return APIKey{}, err
+	}
+	key.ID, _ = primitive.ObjectIDFromHex(id)
+	if err := json.Unmarshal([]byte(scopes), &key.Scopes); err != nil {
+		return APIKey{}, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	return key, nil
+}
+
+func (s *sqliteStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+func (s *sqliteStore) InsertAPIKey(ctx context.Context, key APIKey) error {
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if key.ExpiresAt != nil {
+		expiresAt = *key.ExpiresAt
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.ID.Hex(), key.Name, key.Prefix, key.Hash, string(scopes), key.CreatedBy, key.CreatedAt, expiresAt)
+	return err
+}
+
+func (s *sqliteStore) DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`, id.Hex())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+const auditColumns = `id, action, actor, target, ip, details, before_value, after_value, created_at`
+
+// auditJSON encodes one of the map columns of an audit entry; nil is NULL
+func auditJSON(m map[string]interface{}) (sql.NullString, error) {
+	if m == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func scanAuditEntry(row scanner) (AuditEntry, error) {
+	var (
+		entry                  AuditEntry
+		id                     string
+		details, before, after sql.NullString
+	)
+	if err := row.Scan(&id, &entry.Action, &entry.Actor, &entry.Target, &entry.IP,
+		&details, &before, &after, &entry.CreatedAt); err != nil {
+		return AuditEntry{}, err
+	}
+	entry.ID, _ = primitive.ObjectIDFromHex(id)
+	for _, col := range []struct {
+		value sql.NullString
+		dest  *map[string]interface{}
+	}{{details, &entry.Details}, {before, &entry.Before}, {after, &entry.After}} {
+		if !col.value.Valid {
+			continue
+		}
+		if err := json.Unmarshal([]byte(col.value.String), col.dest); err != nil {
+			return AuditEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+const customerColumns = `id, email, name, phone, addresses, password, created_at`
+
+func scanCustomer(row scanner) (CustomerAccount, error) {
+	var (
+		customer  CustomerAccount
+		id        string
+		addresses string
+	)
+	if err := row.Scan(&id, &customer.Email, &customer.Name, &customer.Phone, &addresses,
+		&customer.PasswordHash, &customer.CreatedAt); err != nil {
+		return CustomerAccount{}, err
+	}
+	customer.ID, _ = primitive.ObjectIDFromHex(id)
+	if err := json.Unmarshal([]byte(addresses), &customer.Addresses); err != nil {
+		return CustomerAccount{}, err
+	}
+	return customer, nil
+}
+
+func (s *sqliteStore) InsertCustomer(ctx context.Context, customer CustomerAccount) error {
+	addresses, err := json.Marshal(customer.Addresses)
+	if err != nil {
+		return err
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM customers WHERE email = ?)`, customer.Email).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrCustomerExists
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO customers (`+customerColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			customer.ID.Hex(), customer.Email, customer.Name, customer.Phone, string(addresses),
+			customer.PasswordHash, customer.CreatedAt)
+		return err
+	})
+}
+
+func (s *sqliteStore) GetCustomerByEmail(ctx context.Context, email string) (CustomerAccount, error) {
+	customer, err := scanCustomer(s.db.QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE email = ?`, email))
+	if err == sql.ErrNoRows {
+		return CustomerAccount{}, ErrNotFound
+	}
+	return customer, err
+}
+
+func (s *sqliteStore) UpdateCustomer(ctx context.Context, id primitive.ObjectID, update CustomerUpdate) (CustomerAccount, error) {
+	// Empty fields keep their current value, and so do nil addresses
+	var addresses sql.NullString
+	if update.Addresses != nil {
+		b, err := json.Marshal(update.Addresses)
+		if err != nil {
+			return CustomerAccount{}, err
+		}
+		addresses = sql.NullString{String: string(b), Valid: true}
+	}
+
+	var customer CustomerAccount
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE customers
+			SET name = COALESCE(NULLIF(?, ''), name),
+				phone = COALESCE(NULLIF(?, ''), phone),
+				addresses = COALESCE(?, addresses)
+			WHERE id = ?`,
+			update.Name, update.Phone, addresses, id.Hex())
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result); err != nil {
+			return err
+		}
+		customer, err = scanCustomer(tx.QueryRowContext(ctx, `SELECT `+customerColumns+` FROM customers WHERE id = ?`, id.Hex()))
+		return err
+	})
+	return customer, err
+}
+
+func (s *sqliteStore) ListCustomerOrders(ctx context.Context, customerID string) ([]Order, error) {
+	// Newest first across the active and delivered orders
+	return s.findOrders(ctx, `SELECT `+orderColumns+` FROM orders WHERE customer_id = ?
+		UNION ALL
+		SELECT `+orderColumns+` FROM delivered WHERE customer_id = ?
+		ORDER BY created_at DESC`, customerID, customerID)
+}
+
+func (s *sqliteStore) InsertMagicLink(ctx context.Context, link MagicLink) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM magic_links WHERE expires_at < ?`, link.CreatedAt); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO magic_links (id, email, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+			link.ID, link.Email, link.CreatedAt, link.ExpiresAt)
+		return err
+	})
+}
+
+func (s *sqliteStore) ConsumeMagicLink(ctx context.Context, id string) (MagicLink, error) {
+	link := MagicLink{ID: id}
+	err := s.db.QueryRowContext(ctx, `DELETE FROM magic_links WHERE id = ? RETURNING email, created_at, expires_at`, id).
+		Scan(&link.Email, &link.CreatedAt, &link.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return MagicLink{}, ErrNotFound
+	}
+	return link, err
+}
+
+// Promotions are stored as JSON, with the columns needed to find coupons
+// and count uses alongside
+const promotionColumns = `definition, uses`
+
+func scanPromotion(row scanner) (Promotion, error) {
+	var (
+		p          Promotion
+		definition string
+		uses       int
+	)
+	if err := row.Scan(&definition, &uses); err != nil {
+		return Promotion{}, err
+	}
+	if err := json.Unmarshal([]byte(definition), &p); err != nil {
+		return Promotion{}, err
+	}
+	p.Uses = uses
+	return p, nil
+}
+
+// nullIfEmpty stores empty strings as NULL, e.g. for unique columns
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *sqliteStore) ListPromotions(ctx context.Context) ([]Promotion, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+promotionColumns+` FROM promotions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []Promotion{}
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+func (s *sqliteStore) GetPromotion(ctx context.Context, id primitive.ObjectID) (Promotion, error) {
+	return getSQLitePromotion(ctx, s.db, id)
+}
+
+func getSQLitePromotion(ctx context.Context, q queryer, id primitive.ObjectID) (Promotion, error) {
+	p, err := scanPromotion(q.QueryRowContext(ctx, `SELECT `+promotionColumns+` FROM promotions WHERE id = ?`, id.Hex()))
+	if err == sql.ErrNoRows {
+		return Promotion{}, ErrNotFound
+	}
+	return p, err
+}
+
+// promotionCodeTaken reports whether a promotion other than id has code
+func promotionCodeTaken(ctx context.Context, tx *sql.Tx, code string, id primitive.ObjectID) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+	var taken bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM promotions WHERE code = ? AND id != ?)`, code, id.Hex()).Scan(&taken)
+	return taken, err
+}
+
+func (s *sqliteStore) InsertPromotion(ctx context.Context, promotion Promotion) error {
+	definition, err := json.Marshal(promotion)
+	if err != nil {
+		return err
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		taken, err := promotionCodeTaken(ctx, tx, promotion.Code, promotion.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrPromotionExists
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO promotions (id, code, definition, max_uses, uses, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			promotion.ID.Hex(), nullIfEmpty(promotion.Code), string(definition), promotion.MaxUses, promotion.Uses, promotion.CreatedAt)
+		return err
+	})
+}
+
+func (s *sqliteStore) UpdatePromotion(ctx context.Context, promotion Promotion) error {
+	definition, err := json.Marshal(promotion)
+	if err != nil {
+		return err
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		taken, err := promotionCodeTaken(ctx, tx, promotion.Code, promotion.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrPromotionExists
+		}
+		// uses is left alone; orders update it meanwhile
+		result, err := tx.ExecContext(ctx, `UPDATE promotions SET code = ?, definition = ?, max_uses = ? WHERE id = ?`,
+			nullIfEmpty(promotion.Code), string(definition), promotion.MaxUses, promotion.ID.Hex())
+		if err != nil {
+			return err
+		}
+		return requireAffected(result)
+	})
+}
+
+func (s *sqliteStore) DeletePromotion(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM promotions WHERE id = ?`, id.Hex())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (s *sqliteStore) AddPromotionUses(ctx context.Context, id primitive.ObjectID, n int) error {
+	return addSQLitePromotionUses(ctx, s.db, id, n)
+}
+
+// addSQLitePromotionUses runs AddPromotionUses on db, which may be a transaction
+func addSQLitePromotionUses(ctx context.Context, db execQueryer, id primitive.ObjectID, n int) error {
+	result, err := db.ExecContext(ctx, `UPDATE promotions SET uses = uses + ?
+		WHERE id = ? AND (? <= 0 OR max_uses = 0 OR uses + ? <= max_uses)`, n, id.Hex(), n, n)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		if _, err := getSQLitePromotion(ctx, db, id); err != nil {
+			return err
+		}
+		return ErrPromotionUsedUp
+	}
+	return nil
+}
+
+func (s *sqliteStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	details, err := auditJSON(entry.Details)
+	if err != nil {
+		return err
+	}
+	before, err := auditJSON(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJSON(entry.After)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO audit_log (`+auditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.ID.Hex(), entry.Action, entry.Actor, entry.Target, entry.IP, details, before, after, entry.CreatedAt)
+	return err
+}
+
+func (s *sqliteStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error) {
+	where := "1 = 1"
+	var args []interface{}
+	for column, value := range map[string]string{"action": filter.Action, "actor": filter.Actor, "target": filter.Target} {
+		if value != "" {
+			where += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, filter.Until)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_log WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log WHERE `+where+`
+		ORDER BY created_at DESC LIMIT ? OFFSET ?`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
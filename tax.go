@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// How an order reaches the customer. Tax rules can differ for each.
+const (
+	FulfillmentDineIn   = "dine_in"
+	FulfillmentTakeaway = "takeaway"
+	FulfillmentDelivery = "delivery"
+)
+
+// defaultFulfillment is used for orders that don't say; the shop started
+// out delivering every order
+const defaultFulfillment = FulfillmentDelivery
+
+// isFulfillment reports whether s is a known fulfillment type
+func isFulfillment(s string) bool {
+	return s == FulfillmentDineIn || s == FulfillmentTakeaway || s == FulfillmentDelivery
+}
+
+// TaxRule sets the tax rate of the order lines it matches. Empty lists
+// match everything.
+type TaxRule struct {
+	Name          string   `json:"name"`
+	Categories    []string `json:"categories,omitempty"`    // Product.Category, e.g. "Hot Drinks"
+	Fulfillment   []string `json:"fulfillment,omitempty"`   // dine_in, takeaway, delivery
+	Jurisdictions []string `json:"jurisdictions,omitempty"` // where the order is taxed, see orderJurisdiction
+	Rate          Percent  `json:"rate"`
+}
+
+// TaxConfig is the shop's tax setup, read from TAX_RULES_FILE. For each
+// order line the first matching rule applies, so list exemptions before
+// the general rules; lines no rule matches are not taxed.
+type TaxConfig struct {
+	// PricesIncludeTax means product prices already contain the tax
+	PricesIncludeTax bool `json:"pricesIncludeTax"`
+	// Jurisdiction of the shop itself, for dine-in and takeaway orders
+	Jurisdiction string    `json:"jurisdiction"`
+	Rules        []TaxRule `json:"rules"`
+}
+
+var taxConfig TaxConfig
+
+// loadTaxConfig reads the tax rules from the JSON file at TAX_RULES_FILE.
+// Without one nothing is taxed.
+func loadTaxConfig() error {
+	path := getEnv("TAX_RULES_FILE", "")
+	if path == "" {
+		log.Println("No TAX_RULES_FILE set, orders are not taxed")
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config TaxConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for i, rule := range config.Rules {
+		for _, f := range rule.Fulfillment {
+			if !isFulfillment(f) {
+				return fmt.Errorf("%s: rule %d (%s): unknown fulfillment %q", path, i+1, rule.Name, f)
+			}
+		}
+	}
+	taxConfig = config
+	log.Printf("Loaded %d tax rules from %s", len(config.Rules), path)
+	return nil
+}
+
+// matches reports whether the rule applies to a line of category in an
+// order with the given fulfillment and jurisdiction
+func (r TaxRule) matches(category, fulfillment, jurisdiction string) bool {
+	return matchesAny(r.Categories, category) &&
+		matchesAny(r.Fulfillment, fulfillment) &&
+		matchesAny(r.Jurisdictions, jurisdiction)
+}
+
+// matchesAny reports whether list is empty or contains value, ignoring case
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// orderJurisdiction is where an order is taxed: the customer's region for
+// deliveries, the shop's own jurisdiction otherwise
+func orderJurisdiction(config TaxConfig, fulfillment string, customer Customer) string {
+	if fulfillment == FulfillmentDelivery {
+		return strings.TrimSpace(customer.Region)
+	}
+	return config.Jurisdiction
+}
+
+// applyTax sets the tax of every line, on the line total less its
+// discount, and returns the order's subtotal (before discounts and tax),
+// tax and total. In both modes total = subtotal - discounts + tax.
+//
+// Discounts are always off the prices as listed, so with PricesIncludeTax
+// they include tax: 5.00 off a 20.00 cake charges 15.00. The subtotal is
+// then the listed prices less the tax in what is charged, which keeps the
+// sum above; it is not the prices net of their own tax.
+func applyTax(config TaxConfig, items []OrderItem, fulfillment string, customer Customer) (subtotal, tax, total Money) {
+	jurisdiction := orderJurisdiction(config, fulfillment, customer)
+	subtotal, tax, total = newMoney(0), newMoney(0), newMoney(0)
+	for i := range items {
+		item := &items[i]
+		item.TaxRate = 0
+		for _, rule := range config.Rules {
+			if rule.matches(item.Category, fulfillment, jurisdiction) {
+				item.TaxRate = rule.Rate
+				break
+			}
+		}
+
+		// Taxed per line, so each line shows the tax it adds
+		charged := item.LineTotal.Sub(item.Discount)
+		if config.PricesIncludeTax {
+			item.Tax = item.TaxRate.IncludedIn(charged)
+			subtotal = subtotal.Add(item.LineTotal.Sub(item.Tax))
+			total = total.Add(charged)
+		} else {
+			item.Tax = item.TaxRate.Of(charged)
+			subtotal = subtotal.Add(item.LineTotal)
+			total = total.Add(charged).Add(item.Tax)
+		}
+		tax = tax.Add(item.Tax)
+	}
+	return subtotal, tax, total
+}
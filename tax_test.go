@@ -0,0 +1,215 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTaxConfig taxes New York at 8.875% and everywhere else at 5%, but
+// doesn't tax bread that leaves the shop
+func testTaxConfig(pricesIncludeTax bool) TaxConfig {
+	return TaxConfig{
+		PricesIncludeTax: pricesIncludeTax,
+		Jurisdiction:     "NY",
+		Rules: []TaxRule{
+			{Name: "Bread to go", Categories: []string{"Breads"}, Fulfillment: []string{FulfillmentTakeaway, FulfillmentDelivery}, Rate: 0},
+			{Name: "New York", Jurisdictions: []string{"NY"}, Rate: 88750},
+			{Name: "Elsewhere", Rate: 50000},
+		},
+	}
+}
+
+func TestApplyTax(t *testing.T) {
+	line := func(category string, lineTotal, discount int64) OrderItem {
+		return OrderItem{Category: category, LineTotal: newMoney(lineTotal), Discount: newMoney(discount)}
+	}
+
+	tests := []struct {
+		name        string
+		inclusive   bool
+		noRules     bool
+		fulfillment string
+		region      string
+		items       []OrderItem
+		wantTaxes   []int64 // per line
+		wantSub     int64
+		wantTotal   int64
+	}{
+		{
+			name:        "exclusive, shop's own rate",
+			fulfillment: FulfillmentDineIn,
+			items:       []OrderItem{line("Cookies", 1000, 0)},
+			wantTaxes:   []int64{89}, // 88.75 rounds up
+			wantSub:     1000,
+			wantTotal:   1089,
+		},
+		{
+			name:        "exclusive, delivered elsewhere",
+			fulfillment: FulfillmentDelivery,
+			region:      "NJ",
+			items:       []OrderItem{line("Cookies", 1000, 0)},
+			wantTaxes:   []int64{50},
+			wantSub:     1000,
+			wantTotal:   1050,
+		},
+		{
+			name:        "exclusive, region matched ignoring case",
+			fulfillment: FulfillmentDelivery,
+			region:      " ny ",
+			items:       []OrderItem{line("Cookies", 1000, 0)},
+			wantTaxes:   []int64{89},
+			wantSub:     1000,
+			wantTotal:   1089,
+		},
+		{
+			name:        "exclusive, exempt line",
+			fulfillment: FulfillmentTakeaway,
+			items:       []OrderItem{line("Breads", 799, 0), line("Cookies", 899, 0)},
+			wantTaxes:   []int64{0, 80}, // 79.79
+			wantSub:     1698,
+			wantTotal:   1778,
+		},
+		{
+			name:        "exclusive, taxed after the discount",
+			fulfillment: FulfillmentDineIn,
+			items:       []OrderItem{line("Cakes", 2000, 500)},
+			wantTaxes:   []int64{133}, // 8.875% of 15.00
+			wantSub:     2000,
+			wantTotal:   1633,
+		},
+		{
+			name:        "exclusive, rounded per line",
+			fulfillment: FulfillmentDelivery,
+			region:      "NJ",
+			items:       []OrderItem{line("Cookies", 10, 0), line("Cookies", 10, 0), line("Cookies", 10, 0)},
+			wantTaxes:   []int64{1, 1, 1}, // 0.5 each
+			wantSub:     30,
+			wantTotal:   33,
+		},
+		{
+			name:        "inclusive",
+			inclusive:   true,
+			fulfillment: FulfillmentDineIn,
+			items:       []OrderItem{line("Cookies", 1089, 0)},
+			wantTaxes:   []int64{89},
+			wantSub:     1000,
+			wantTotal:   1089,
+		},
+		{
+			name:        "inclusive, after the discount",
+			inclusive:   true,
+			fulfillment: FulfillmentDineIn,
+			items:       []OrderItem{line("Cakes", 2000, 500)},
+			wantTaxes:   []int64{122}, // the tax in 15.00
+			wantSub:     1878,
+			wantTotal:   1500,
+		},
+		{
+			name:        "inclusive, exempt line",
+			inclusive:   true,
+			fulfillment: FulfillmentDelivery,
+			region:      "NY",
+			items:       []OrderItem{line("Breads", 799, 0)},
+			wantTaxes:   []int64{0},
+			wantSub:     799,
+			wantTotal:   799,
+		},
+		{
+			name:        "no rules",
+			noRules:     true,
+			fulfillment: FulfillmentDineIn,
+			items:       []OrderItem{line("Cookies", 1000, 100)},
+			wantTaxes:   []int64{0},
+			wantSub:     1000,
+			wantTotal:   900,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testTaxConfig(tt.inclusive)
+			if tt.noRules {
+				config.Rules = nil
+			}
+			subtotal, tax, total := applyTax(config, tt.items, tt.fulfillment, Customer{Region: tt.region})
+
+			var wantTax, discount int64
+			for i, item := range tt.items {
+				if item.Tax != newMoney(tt.wantTaxes[i]) {
+					t.Errorf("line %d tax = %v, want %d cents", i, item.Tax, tt.wantTaxes[i])
+				}
+				wantTax += tt.wantTaxes[i]
+				discount += item.Discount.Cents
+			}
+			if subtotal != newMoney(tt.wantSub) || tax != newMoney(wantTax) || total != newMoney(tt.wantTotal) {
+				t.Errorf("subtotal, tax, total = %v, %v, %v; want %d, %d, %d cents", subtotal, tax, total, tt.wantSub, wantTax, tt.wantTotal)
+			}
+			// The totals always add up the same way, whichever the mode
+			if subtotal.Cents-discount+tax.Cents != total.Cents {
+				t.Errorf("%v - %d + %v != %v", subtotal, discount, tax, total)
+			}
+		})
+	}
+}
+
+func TestApplyTaxInclusiveDiscountIncludesTax(t *testing.T) {
+	// 5.00 off a 20.00 cake at 8.875%, tax included
+	items := []OrderItem{{Category: "Cakes", LineTotal: newMoney(2000), Discount: newMoney(500)}}
+	subtotal, tax, total := applyTax(testTaxConfig(true), items, FulfillmentDineIn, Customer{})
+
+	// The customer pays the listed price less the whole discount
+	if total != newMoney(1500) {
+		t.Errorf("total = %v, want 15.00", total)
+	}
+	// Only the 15.00 charged carries tax
+	if tax != newMoney(122) {
+		t.Errorf("tax = %v, want 1.22", tax)
+	}
+	// The subtotal is the listed price less that tax
+	if subtotal != newMoney(2000-122) {
+		t.Errorf("subtotal = %v, want 18.78", subtotal)
+	}
+}
+
+func TestApplyTaxSetsRates(t *testing.T) {
+	items := []OrderItem{{Category: "Breads", LineTotal: newMoney(100)}, {Category: "Cookies", LineTotal: newMoney(100)}}
+	applyTax(testTaxConfig(false), items, FulfillmentTakeaway, Customer{})
+	if items[0].TaxRate != 0 || items[1].TaxRate != 88750 {
+		t.Errorf("rates = %s, %s; want 0, 8.875", items[0].TaxRate, items[1].TaxRate)
+	}
+}
+
+func TestLoadTaxConfig(t *testing.T) {
+	defer func(old TaxConfig) { taxConfig = old }(taxConfig)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Setenv("TAX_RULES_FILE", write("good.json", `{
+		"pricesIncludeTax": true,
+		"jurisdiction": "NY",
+		"rules": [{"name": "NY", "jurisdictions": ["NY"], "rate": "8.875"}]
+	}`))
+	if err := loadTaxConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !taxConfig.PricesIncludeTax || len(taxConfig.Rules) != 1 || taxConfig.Rules[0].Rate != 88750 {
+		t.Errorf("loaded %+v", taxConfig)
+	}
+
+	for name, content := range map[string]string{
+		"fulfillment.json": `{"rules": [{"name": "x", "fulfillment": ["drive_thru"], "rate": "5"}]}`,
+		"rate.json":        `{"rules": [{"name": "x", "rate": "150"}]}`,
+		"syntax.json":      `{"rules": [`,
+	} {
+		t.Setenv("TAX_RULES_FILE", write(name, content))
+		if err := loadTaxConfig(); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
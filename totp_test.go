@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Key is the SHA-1 key of the RFC 6238 test vectors
+var rfc6238Key = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	codeAt := func(step int64) string { return totpCode(rfc6238Key, current+step) }
+
+	tests := []struct {
+		name        string
+		secret      string
+		code        string
+		lastCounter int64
+		wantCounter int64
+		wantOK      bool
+	}{
+		{"current", secret, codeAt(0), 0, current, true},
+		{"previous step", secret, codeAt(-1), 0, current - 1, true},
+		{"next step", secret, codeAt(1), 0, current + 1, true},
+		{"two steps old", secret, codeAt(-2), 0, 0, false},
+		{"two steps ahead", secret, codeAt(2), 0, 0, false},
+		{"already used", secret, codeAt(0), current, 0, false},
+		{"older than last used", secret, codeAt(-1), current, 0, false},
+		{"newer than last used", secret, codeAt(1), current, current + 1, true},
+		{"spaces", secret, codeAt(0)[:3] + " " + codeAt(0)[3:], 0, current, true},
+		{"lower case secret", strings.ToLower(secret), codeAt(0), 0, current, true},
+		{"too short", secret, codeAt(0)[:5], 0, 0, false},
+		{"too long", secret, codeAt(0) + "1", 0, 0, false},
+		{"bad secret", "not base32!", codeAt(0), 0, 0, false},
+	}
+	for _, tt := range tests {
+		counter, ok := verifyTOTP(tt.secret, tt.code, now, tt.lastCounter)
+		if ok != tt.wantOK || counter != tt.wantCounter {
+			t.Errorf("%s: got (%d, %v), want (%d, %v)", tt.name, counter, ok, tt.wantCounter, tt.wantOK)
+		}
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q is not base32: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("key is %d bytes, want 20", len(key))
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("code %s given twice", code)
+		}
+		seen[code] = true
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash of %s doesn't match", code)
+		}
+		// Codes are accepted however they are typed
+		typed := strings.ToUpper(strings.ReplaceAll(code, "-", "")) + " "
+		if hashRecoveryCode(typed) != hashes[i] {
+			t.Errorf("%q doesn't match %s", typed, code)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrTwoFactorConflict is returned by Store.UpdateUserTwoFactor when the
+// settings changed since they were read
+var ErrTwoFactorConflict = errors.New("two-factor settings changed concurrently")
+
+// twoFactorChallengeTTL is how long the second login step may take
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// TwoFactor holds a staff account's TOTP settings. Secret is set from
+// setup on, Enabled only once a code from the authenticator app has been
+// confirmed. Version increases with every change, see UpdateUserTwoFactor.
+type TwoFactor struct {
+	Enabled       bool     `bson:"enabled" json:"enabled"`
+	Secret        string   `bson:"secret,omitempty" json:"-"`
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty" json:"-"` // hashes of the unused codes
+	LastCounter   int64    `bson:"lastCounter,omitempty" json:"-"`   // time step of the last accepted code
+	Version       int      `bson:"version" json:"-"`
+}
+
+// checkSecondFactor verifies a TOTP or recovery code for user and, when it
+// is valid, records it as used so it can't be replayed
+func checkSecondFactor(ctx context.Context, user StaffUser, code string) (bool, error) {
+	tf := user.TwoFactor
+	if counter, ok := verifyTOTP(tf.Secret, code, time.Now(), tf.LastCounter); ok {
+		tf.LastCounter = counter
+	} else {
+		hash := hashRecoveryCode(code)
+		used := -1
+		for i, h := range tf.RecoveryCodes {
+			if h == hash {
+				used = i
+				break
+			}
+		}
+		if used < 0 {
+			return false, nil
+		}
+		tf.RecoveryCodes = append(append([]string{}, tf.RecoveryCodes[:used]...), tf.RecoveryCodes[used+1:]...)
+	}
+
+	err := store.UpdateUserTwoFactor(ctx, user.Username, user.TwoFactor.Version, tf)
+	if errors.Is(err, ErrTwoFactorConflict) {
+		// Someone else used a code at the same moment; it may have been this one
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// currentUser loads the logged-in staff account
+func currentUser(ctx context.Context, c *gin.Context) (StaffUser, bool) {
+	user, err := store.GetUser(ctx, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return StaffUser{}, false
+	}
+	return user, true
+}
+
+// confirmPassword checks the logged-in user's password before a 2FA change.
+// Wrong passwords count as failed logins, so a stolen session can't be used
+// to guess the password either. It answers the request itself when the
+// password isn't accepted.
+func confirmPassword(ctx context.Context, c *gin.Context, user StaffUser, password string) bool {
+	until, err := loginBlockedUntil(ctx, user.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password"})
+		return false
+	}
+	if !until.IsZero() {
+		rejectThrottledLogin(c, until)
+		return false
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		recordLoginFailure(ctx, c, user.Username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return false
+	}
+	return true
+}
+
+// setupTwoFactor starts 2FA enrollment: it creates a new secret and returns
+// it with the provisioning URI to show as a QR code. 2FA stays off until
+// enableTwoFactor confirms a code.
+func setupTwoFactor(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !confirmPassword(ctx, c, user, req.Password) {
+		return
+	}
+	if user.TwoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	if err := store.UpdateUserTwoFactor(ctx, user.Username, user.TwoFactor.Version, TwoFactor{Secret: secret}); err != nil {
+		if errors.Is(err, ErrTwoFactorConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor settings changed, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    totpURI(secret, user.Username),
+	})
+}
+
+// enableTwoFactor confirms enrollment with a code from the authenticator
+// app and returns the recovery codes, which are shown only this once
+func enableTwoFactor(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.TwoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TwoFactor.Secret == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Set up two-factor authentication first"})
+		return
+	}
+	counter, valid := verifyTOTP(user.TwoFactor.Secret, req.Code, time.Now(), user.TwoFactor.LastCounter)
+	if !valid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	tf := TwoFactor{Enabled: true, Secret: user.TwoFactor.Secret, RecoveryCodes: hashes, LastCounter: counter}
+	if err := store.UpdateUserTwoFactor(ctx, user.Username, user.TwoFactor.Version, tf); err != nil {
+		if errors.Is(err, ErrTwoFactorConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor settings changed, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	recordAudit(c, AuditTwoFactorEnabled, user.Username, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recoveryCodes": codes})
+}
+
+// disableTwoFactor turns 2FA off after checking the password and a code
+func disableTwoFactor(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password and code are required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.TwoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !confirmPassword(ctx, c, user, req.Password) {
+		return
+	}
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// checkSecondFactor bumped the version when it recorded the code
+	if err := store.UpdateUserTwoFactor(ctx, user.Username, user.TwoFactor.Version+1, TwoFactor{}); err != nil {
+		if errors.Is(err, ErrTwoFactorConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor settings changed, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	recordAudit(c, AuditTwoFactorDisabled, user.Username, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// regenerateRecoveryCodes replaces the recovery codes after checking a code
+func regenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.TwoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// Re-read the settings, checkSecondFactor has just changed them
+	user, ok = currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	tf := user.TwoFactor
+	tf.RecoveryCodes = hashes
+	if err := store.UpdateUserTwoFactor(ctx, user.Username, user.TwoFactor.Version, tf); err != nil {
+		if errors.Is(err, ErrTwoFactorConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor settings changed, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// resetTwoFactor lets an owner turn off 2FA for a staff member who lost
+// their authenticator and recovery codes
+func resetTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := normalizeUsername(c.Param("username"))
+	user, err := store.GetUser(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	if err := store.UpdateUserTwoFactor(ctx, username, user.TwoFactor.Version, TwoFactor{}); err != nil {
+		if errors.Is(err, ErrTwoFactorConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor settings changed, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+
+	recordAudit(c, AuditTwoFactorReset, username, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
+
+// handleLoginTwoFactor is the second login step for accounts with 2FA. It
+// takes the challenge from handleLogin and a TOTP or recovery code.
+func handleLoginTwoFactor(c *gin.Context) {
+	var req struct {
+		Challenge string `json:"challenge" binding:"required"`
+		Code      string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	challenge, err := sessions.GetSession(ctx, sessionID(req.Challenge))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if err != nil || !challenge.TwoFactorPending || time.Now().After(challenge.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, start again"})
+		return
+	}
+
+	// Wrong codes count as failed logins, so codes can't be guessed either
+	until, err := loginBlockedUntil(ctx, challenge.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if !until.IsZero() {
+		rejectThrottledLogin(c, until)
+		return
+	}
+
+	user, err := store.GetUser(ctx, challenge.Username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, start again"})
+		return
+	}
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if !valid {
+		recordLoginFailure(ctx, c, user.Username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := sessions.DeleteSession(ctx, challenge.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	completeLogin(ctx, c, user)
+}
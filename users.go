@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrUserExists is returned by Store.InsertUser when the username is taken
+var ErrUserExists = errors.New("user already exists")
+
+// Staff roles
+const (
+	RoleOwner   = "owner"
+	RoleManager = "manager"
+	RoleBaker   = "baker"
+	RoleCashier = "cashier"
+	RoleDriver  = "driver"
+)
+
+// Permission is something a staff role is allowed to do
+type Permission string
+
+const (
+	PermOrdersRead       Permission = "orders:read"
+	PermOrdersConfirm    Permission = "orders:confirm" // pending → confirmed
+	PermOrdersPrepare    Permission = "orders:prepare" // baking, ready
+	PermOrdersDeliver    Permission = "orders:deliver" // out-for-delivery, picked-up, delivered
+	PermOrdersCancel     Permission = "orders:cancel"
+	PermOrdersRefund     Permission = "orders:refund"
+	PermProductsWrite    Permission = "products:write"
+	PermPromotionsManage Permission = "promotions:manage"
+	PermUsersManage      Permission = "users:manage"
+	PermAuditRead        Permission = "audit:read"
+)
+
+// rolePermissions lists what each role may do
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermOrdersRead, PermOrdersConfirm, PermOrdersPrepare, PermOrdersDeliver,
+		PermOrdersCancel, PermOrdersRefund, PermProductsWrite, PermPromotionsManage,
+		PermUsersManage, PermAuditRead,
+	},
+	RoleManager: {
+		PermOrdersRead, PermOrdersConfirm, PermOrdersPrepare, PermOrdersDeliver,
+		PermOrdersCancel, PermOrdersRefund, PermProductsWrite, PermPromotionsManage,
+	},
+	RoleBaker:   {PermOrdersRead, PermOrdersConfirm, PermOrdersPrepare},
+	RoleCashier: {PermOrdersRead, PermOrdersConfirm, PermOrdersDeliver, PermOrdersCancel},
+	RoleDriver:  {PermOrdersRead, PermOrdersDeliver},
+}
+
+// statusPermissions is the permission needed to move an order into each status
+var statusPermissions = map[string]Permission{
+	StatusConfirmed:      PermOrdersConfirm,
+	StatusBaking:         PermOrdersPrepare,
+	StatusReady:          PermOrdersPrepare,
+	StatusOutForDelivery: PermOrdersDeliver,
+	StatusPickedUp:       PermOrdersDeliver,
+	StatusDelivered:      PermOrdersDeliver,
+	StatusCancelled:      PermOrdersCancel,
+	StatusRefunded:       PermOrdersRefund,
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,31}$`)
+
+var (
+	errInvalidUsername = errors.New("Username must be 2-32 letters, digits, dots, dashes or underscores")
+	errUnknownRole     = errors.New("Unknown role")
+)
+
+// StaffUser is a staff account
+type StaffUser struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username     string             `bson:"username" json:"username"`
+	Name         string             `bson:"name" json:"name"`
+	Role         string             `bson:"role" json:"role"`
+	PasswordHash string             `bson:"password" json:"-"` // bcrypt hash, never the password itself
+	TwoFactor    TwoFactor          `bson:"twoFactor" json:"twoFactor"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// StaffUserUpdate holds the editable fields of a staff account.
+// Empty fields are left untouched.
+type StaffUserUpdate struct {
+	Name         string
+	Role         string
+	PasswordHash string
+}
+
+// isRole reports whether role is a known staff role
+func isRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// hasPermission reports whether perms contains perm
+func hasPermission(perms []Permission, perm Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// roleCan reports whether role has permission perm
+func roleCan(role string, perm Permission) bool {
+	return hasPermission(rolePermissions[role], perm)
+}
+
+// canSetStatus reports whether someone with perms may move orders into status
+func canSetStatus(perms []Permission, status string) bool {
+	perm, ok := statusPermissions[status]
+	return ok && hasPermission(perms, perm)
+}
+
+// requestPermissions returns the permissions of the staff member or API
+// key making the request, as set by requireAuth
+func requestPermissions(c *gin.Context) []Permission {
+	perms, _ := c.Get("permissions")
+	list, _ := perms.([]Permission)
+	return list
+}
+
+// normalizeUsername makes usernames case-insensitive
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// ensureOwnerAccount creates the first owner from ADMIN_USERNAME and
+// ADMIN_PASSWORD when there are no staff accounts yet. Without
+// ADMIN_PASSWORD no account is created; run the create-admin command instead.
+func ensureOwnerAccount(ctx context.Context) error {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		log.Println("No staff accounts yet. Run the create-admin command to add the first owner")
+		return nil
+	}
+
+	owner, err := newStaffUser(getEnv("ADMIN_USERNAME", "admin"), "Owner", RoleOwner, password)
+	if err != nil {
+		return err
+	}
+	if err := store.InsertUser(ctx, owner); err != nil && !errors.Is(err, ErrUserExists) {
+		return err
+	}
+	log.Printf("Created owner account %q from ADMIN_USERNAME/ADMIN_PASSWORD", owner.Username)
+	return nil
+}
+
+// newStaffUser validates a new account and hashes its password
+func newStaffUser(username, name, role, password string) (StaffUser, error) {
+	username = normalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return StaffUser{}, errInvalidUsername
+	}
+	if !isRole(role) {
+		return StaffUser{}, errUnknownRole
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return StaffUser{}, err
+	}
+	return StaffUser{
+		ID:           primitive.NewObjectID(),
+		Username:     username,
+		Name:         name,
+		Role:         role,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// countOwners returns how many owner accounts exist
+func countOwners(ctx context.Context) (int, error) {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, u := range users {
+		if u.Role == RoleOwner {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// getUsers lists all staff accounts
+func getUsers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// createUser adds a staff account
+func createUser(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Name     string `json:"name"`
+		Role     string `json:"role" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, err := newStaffUser(req.Username, req.Name, req.Role, req.Password)
+	if err != nil {
+		if errors.Is(err, errInvalidUsername) || errors.Is(err, errUnknownRole) || errors.Is(err, errWeakPassword) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.InsertUser(ctx, user); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	recordAuditChange(c, AuditUserCreated, user.Username, nil, user)
+	c.JSON(http.StatusCreated, user)
+}
+
+// updateUser changes a staff account's name, role or password. Changing
+// the role or password logs the user out everywhere.
+func updateUser(c *gin.Context) {
+	var req struct {
+		Name     string `json:"name"`
+		Role     string `json:"role"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Role != "" && !isRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := normalizeUsername(c.Param("username"))
+	existing, err := store.GetUser(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	if existing.Role == RoleOwner && req.Role != "" && req.Role != RoleOwner {
+		if owners, err := countOwners(ctx); err != nil || owners <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The last owner cannot be demoted"})
+			return
+		}
+	}
+
+	update := StaffUserUpdate{Name: req.Name, Role: req.Role}
+	if req.Password != "" {
+		update.PasswordHash, err = hashPassword(req.Password)
+		if err != nil {
+			if errors.Is(err, errWeakPassword) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+	}
+
+	user, err := store.UpdateUser(ctx, username, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	if user.Role != existing.Role || req.Password != "" {
+		revokeUserSessions(username)
+	}
+
+	after := auditValue(user)
+	if after != nil && req.Password != "" {
+		after["passwordChanged"] = true
+	}
+	recordAuditChange(c, AuditUserUpdated, username, existing, after)
+	c.JSON(http.StatusOK, user)
+}
+
+// deleteUser removes a staff account and logs it out everywhere
+func deleteUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := normalizeUsername(c.Param("username"))
+	existing, err := store.GetUser(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	if existing.Role == RoleOwner {
+		if owners, err := countOwners(ctx); err != nil || owners <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The last owner cannot be deleted"})
+			return
+		}
+	}
+
+	if err := store.DeleteUser(ctx, username); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	revokeUserSessions(username)
+	recordAuditChange(c, AuditUserDeleted, username, existing, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
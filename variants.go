@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProductVariant is one way a product is sold, such as a size or a flavour,
+// with its own price and SKU
+type ProductVariant struct {
+	SKU       string `bson:"sku" json:"sku"`
+	Name      string `bson:"name" json:"name"` // e.g. `8"` or "Vanilla"
+	Price     Money  `bson:"price" json:"price"`
+	Available bool   `bson:"available" json:"available"`
+}
+
+// ErrSKUExists means another product already sells a variant with the SKU
+var ErrSKUExists = errors.New("SKU already exists")
+
+// skuTakenMessage answers a product change the store turned down for a
+// taken SKU that checkSKUs didn't see
+const skuTakenMessage = "One of the variant SKUs is already used by another product"
+
+var skuPattern = regexp.MustCompile(`^[A-Z0-9._-]{1,64}$`)
+
+// variantRequest is a variant as sent to product create and update;
+// variants are available unless they say otherwise
+type variantRequest struct {
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Price     Money  `json:"price"`
+	Available *bool  `json:"available"`
+}
+
+// normalizeSKU returns sku the way it is stored, upper case
+func normalizeSKU(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// parseVariants reads the variants form field of a product, a JSON array
+// like [{"sku": "CAKE-CHOC-8", "name": "8\"", "price": "34.99"}]. An
+// empty field means no variants.
+func parseVariants(s string) ([]ProductVariant, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var reqs []variantRequest
+	if err := json.Unmarshal([]byte(s), &reqs); err != nil {
+		if errors.Is(err, errInvalidMoney) {
+			return nil, errors.New("Variant prices must be decimal numbers like 34.99")
+		}
+		if errors.Is(err, errWrongCurrency) {
+			return nil, errors.New("Variant prices must be in " + shopCurrency)
+		}
+		return nil, errors.New("Variants must be a JSON array of {sku, name, price, available}")
+	}
+
+	variants := make([]ProductVariant, 0, len(reqs))
+	seen := make(map[string]bool)
+	for i, req := range reqs {
+		sku := normalizeSKU(req.SKU)
+		name := strings.TrimSpace(req.Name)
+		switch {
+		case !skuPattern.MatchString(sku):
+			return nil, fmt.Errorf("Variant %d: SKU must be 1-64 letters, digits, '.', '-' or '_'", i+1)
+		case seen[sku]:
+			return nil, fmt.Errorf("Variant %d: SKU %s is listed twice", i+1, sku)
+		case name == "":
+			return nil, fmt.Errorf("Variant %d needs a name, e.g. 8\"", i+1)
+		case req.Price.Cents <= 0 || req.Price.Currency != shopCurrency:
+			return nil, fmt.Errorf("Variant %d needs a valid price, e.g. 34.99", i+1)
+		}
+		seen[sku] = true
+
+		variants = append(variants, ProductVariant{
+			SKU:       sku,
+			Name:      name,
+			Price:     req.Price,
+			Available: req.Available == nil || *req.Available,
+		})
+	}
+	return variants, nil
+}
+
+// fromPrice is the price shown for a product with variants: the lowest
+// price of an available variant, or of any variant if none is available
+func fromPrice(variants []ProductVariant) Money {
+	var lowest Money
+	haveAvailable := false
+	for _, v := range variants {
+		better := lowest.IsZero() || v.Available && !haveAvailable ||
+			v.Available == haveAvailable && v.Price.Cents < lowest.Cents
+		if better {
+			lowest = v.Price
+			haveAvailable = haveAvailable || v.Available
+		}
+	}
+	return lowest
+}
+
+// variant returns the product's variant with the SKU, ignoring case
+func (p Product) variant(sku string) (ProductVariant, bool) {
+	sku = normalizeSKU(sku)
+	for _, v := range p.Variants {
+		if v.SKU == sku {
+			return v, true
+		}
+	}
+	return ProductVariant{}, false
+}
+
+// checkSKUs returns ErrSKUExists, with the SKU and the product using it,
+// if a product other than id already has one of the variants' SKUs. It
+// is only for the message; the stores enforce unique SKUs themselves.
+func checkSKUs(ctx context.Context, id primitive.ObjectID, variants []ProductVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	productsList, err := store.ListProducts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range productsList {
+		if p.ID == id {
+			continue
+		}
+		for _, v := range variants {
+			if _, ok := p.variant(v.SKU); ok {
+				return fmt.Errorf("%w: %s is used by %s", ErrSKUExists, v.SKU, p.Name)
+			}
+		}
+	}
+	return nil
+}